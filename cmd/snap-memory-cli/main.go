@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"snap-memory-downloader/internal/app"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes returned by the CLI.
+const (
+	exitOK         = 0
+	exitItemFailed = 1
+	exitUsage      = 2
+	exitCanceled   = 130
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("snap-memory-cli", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: snap-memory-cli [options] -input <memories_history.html|json|mydata~*.zip> [more exports...]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+
+	cfg := app.Config{}
+	input := fs.String("input", "", "path to memories_history.html, memories_history.json or the mydata~*.zip export")
+	fs.StringVar(&cfg.OutputDir, "output", "./output", "directory to write memories to")
+	fs.IntVar(&cfg.Concurrency, "workers", runtime.NumCPU(), "number of parallel downloads")
+	fs.BoolVar(&cfg.SkipImageOverlay, "skip-image-overlay", false, "save images without merging their overlay")
+	fs.BoolVar(&cfg.SkipVideoOverlay, "skip-video-overlay", false, "save videos without merging their overlay (no ffmpeg needed)")
+	fs.BoolVar(&cfg.KeepArchives, "keep-archives", false, "keep the original ZIP archives of overlay memories")
+	fs.StringVar(&cfg.DateFormat, "date-format", "", "custom date format for file names, e.g. YYYYMMDD_HHmmss")
+	nameTemplate := fs.String("name-template", app.DefaultNameTemplate, "layout of output paths, e.g. {year}/{month}/{type}_{date:YYYYMMDD_HHmmss}_{seq}{ext}")
+	timeZone := fs.String("timezone", "UTC", "time zone of folders, file names and EXIF dates: an IANA zone such as Europe/Paris, Local, or auto to infer it from each memory's location")
+	fs.IntVar(&cfg.Retries, "retries", app.DefaultRetries, "number of retries for downloads that fail transiently")
+	fs.DurationVar(&cfg.RetryBaseDelay, "retry-delay", time.Second, "initial backoff between retries, doubled on every attempt")
+	fs.DurationVar(&cfg.RetryMaxDelay, "retry-max-delay", 30*time.Second, "maximum backoff between retries")
+	fs.BoolVar(&cfg.XMP, "xmp", false, "write XMP sidecars next to every memory and embed XMP in JPEG images")
+	fs.BoolVar(&cfg.Redownload, "redownload", false, "download everything again, ignoring memories a previous run completed")
+	refresh := fs.String("refresh", "", "newer export whose links replace those of memories that are not downloaded yet (for expired links)")
+	quiet := fs.Bool("quiet", false, "do not print the progress bar")
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	// Further exports, e.g. ones requested months apart, are merged with the first.
+	if *input != "" {
+		cfg.InputFiles = append(cfg.InputFiles, *input)
+	}
+	cfg.InputFiles = append(cfg.InputFiles, fs.Args()...)
+	if len(cfg.InputFiles) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	zone, err := app.ParseTimeZone(*timeZone)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	cfg.TimeZone = zone
+	if cfg.NameTemplate, err = app.ParseNameTemplate(*nameTemplate); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// A single JSON export is streamed, so downloads start while it is parsed.
+	var stream *app.JSONStream
+	if len(cfg.InputFiles) == 1 && *refresh == "" {
+		var err error
+		stream, err = app.OpenJSONStream(ctx, cfg.InputFiles[0])
+		if err != nil && !errors.Is(err, app.ErrNotStreamable) {
+			fmt.Fprintf(os.Stderr, "Error: failed to parse input file: %v\n", err)
+			return exitUsage
+		}
+	}
+	var parsed app.ParseResult
+	if stream == nil {
+		var err error
+		parsed, err = app.LoadInputs(cfg.InputFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to parse input file: %v\n", err)
+			return exitUsage
+		}
+		printWarnings(parsed.Warnings)
+		fmt.Printf("Read %s: %s\n", strings.Join(cfg.InputFiles, ", "), parsed)
+	}
+
+	journal, err := app.OpenJournal(app.JournalPath(cfg.OutputDir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to open download journal: %v\n", err)
+		return exitUsage
+	}
+	defer journal.Close()
+	if n := journal.Len(); n > 0 && !cfg.Redownload {
+		fmt.Printf("Resuming: %d memories recorded by previous runs\n", n)
+	}
+
+	var runner *app.Runner
+	if stream != nil {
+		fmt.Printf("Reading %s, downloading with %d workers to %s\n", cfg.InputFiles[0], cfg.Concurrency, cfg.OutputDir)
+		runner = app.NewStreamRunner(cfg, stream.Items())
+	} else {
+		memories := parsed.Items
+		if *refresh != "" {
+			fresh, err := app.LoadInput(*refresh)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to parse refresh file: %v\n", err)
+				return exitUsage
+			}
+			pending := journal.Pending(memories)
+			refreshed, matched := app.RefreshItems(pending, fresh.Items)
+			memories = app.ReplaceItems(memories, refreshed)
+			fmt.Printf("Refreshed links for %d of %d pending memories from %s\n", matched, len(pending), *refresh)
+		}
+
+		if len(memories) == 0 {
+			fmt.Println("No memories to download")
+			return exitOK
+		}
+		fmt.Printf("Found %d memories, downloading with %d workers to %s\n", len(memories), cfg.Concurrency, cfg.OutputDir)
+		runner = app.NewRunner(cfg, memories)
+	}
+
+	runner.SetJournal(journal)
+	completed := 0
+	startTime := time.Now()
+	for ev := range runner.Run(ctx) {
+		if !ev.Terminal() {
+			continue
+		}
+		completed++
+		switch ev.Kind {
+		case app.EventFailed:
+			fmt.Fprintf(os.Stderr, "\rError: %v\n", ev.Err)
+		case app.EventSkipped:
+			if errors.Is(ev.Err, app.ErrAlreadyDownloaded) {
+				break
+			}
+			fmt.Fprintf(os.Stderr, "\rSkipped: %v\n", ev.Err)
+		}
+		if !*quiet {
+			app.PrintProgress(completed, runner.Total(), startTime)
+		}
+	}
+	if !*quiet {
+		fmt.Println()
+	}
+
+	var streamErr error
+	if stream != nil {
+		var streamed app.ParseResult
+		streamed, streamErr = stream.Wait()
+		printWarnings(streamed.Warnings)
+		fmt.Printf("Read %s: %d parsed, %d skipped\n", cfg.InputFiles[0], runner.Total(), len(streamed.Warnings))
+	}
+
+	summary := runner.Summary()
+	if ctx.Err() != nil {
+		fmt.Printf("Interrupted after %s: %s\n", time.Since(startTime).Round(time.Second), summary)
+		return exitCanceled
+	}
+	fmt.Printf("Processed %d memories in %s: %s\n", summary.Total, time.Since(startTime).Round(time.Second), summary)
+	if streamErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to parse input file: %v\n", streamErr)
+		return exitUsage
+	}
+	if summary.Expired > 0 {
+		fmt.Printf("%d links expired: request a new export and run again with -refresh <new export>\n", summary.Expired)
+	}
+	if summary.Failed > 0 || summary.Expired > 0 {
+		return exitItemFailed
+	}
+	return exitOK
+}
+
+// printWarnings lists the entries of the input that could not be read.
+func printWarnings(warnings []app.ParseWarning) {
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Skipped %s\n    %s\n", w, w.Raw)
+	}
+}
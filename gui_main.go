@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image/color"
 	"os"
-	"path/filepath"
 	"runtime"
 	"snap-memory-downloader/internal/app"
-	"sync"
+	"strings"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -22,19 +23,28 @@ import (
 type GuiApp struct {
 	window         fyne.Window
 	inputFile      *widget.Entry
+	refreshFile    *widget.Entry
 	outputDir      *widget.Entry
 	workers        *widget.Entry
+	retries        *widget.Entry
 	skipImageCheck *widget.Check
 	skipVideoCheck *widget.Check
 	keepArchCheck  *widget.Check
+	redownloadChk  *widget.Check
+	xmpCheck       *widget.Check
 	dateFormat     *widget.Entry
+	timeZone       *widget.Entry
+	nameTemplate   *widget.Entry
+	namePreview    *widget.Label
 	debugCheck     *widget.Check
 	progressBar    *widget.ProgressBar
 	statusLabel    *widget.Label
 	logOutput      *widget.Entry
 	startButton    *widget.Button
+	cancelButton   *widget.Button
 	tabs           *container.AppTabs
 	isProcessing   bool
+	cancel         context.CancelFunc
 }
 
 func main() {
@@ -53,8 +63,12 @@ func (g *GuiApp) setupUI() {
 	// Set up window-level drop handling
 	g.window.SetOnDropped(func(pos fyne.Position, uris []fyne.URI) {
 		if len(uris) > 0 {
-			// Use the first dropped file
-			g.inputFile.SetText(uris[0].Path())
+			// Several exports are merged into one download set
+			paths := make([]string, len(uris))
+			for i, uri := range uris {
+				paths[i] = uri.Path()
+			}
+			g.inputFile.SetText(strings.Join(paths, inputSeparator))
 		}
 	})
 
@@ -73,6 +87,20 @@ func (g *GuiApp) setupUI() {
 	g.window.SetContent(g.tabs)
 }
 
+// inputSeparator separates the exports listed in the input field.
+const inputSeparator = "; "
+
+// inputPaths returns the exports listed in the input field.
+func (g *GuiApp) inputPaths() []string {
+	var paths []string
+	for _, path := range strings.Split(g.inputFile.Text, ";") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
 func (g *GuiApp) createConfigTab() fyne.CanvasObject {
 	// Helper for small labels
 	smallLabel := func(text string) fyne.CanvasObject {
@@ -81,7 +109,7 @@ func (g *GuiApp) createConfigTab() fyne.CanvasObject {
 
 	// Input file section with drag-and-drop
 	g.inputFile = widget.NewEntry()
-	g.inputFile.SetPlaceHolder("Drop HTML/JSON file here...")
+	g.inputFile.SetPlaceHolder("Drop HTML/JSON files or export ZIPs here...")
 	g.inputFile.OnChanged = func(s string) {} // Compact
 
 	inputBrowse := widget.NewButton("...", func() {
@@ -95,6 +123,21 @@ func (g *GuiApp) createConfigTab() fyne.CanvasObject {
 	})
 	inputBrowse.Importance = widget.LowImportance
 
+	// Optional newer export used to refresh expired links
+	g.refreshFile = widget.NewEntry()
+	g.refreshFile.SetPlaceHolder("Optional: newer export to refresh expired links")
+
+	refreshBrowse := widget.NewButton("...", func() {
+		dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			g.refreshFile.SetText(reader.URI().Path())
+			reader.Close()
+		}, g.window)
+	})
+	refreshBrowse.Importance = widget.LowImportance
+
 	// Output directory
 	g.outputDir = widget.NewEntry()
 	g.outputDir.SetText("./output")
@@ -113,22 +156,54 @@ func (g *GuiApp) createConfigTab() fyne.CanvasObject {
 	g.workers = widget.NewEntry()
 	g.workers.SetText(fmt.Sprintf("%d", runtime.NumCPU()))
 
+	// Retries
+	g.retries = widget.NewEntry()
+	g.retries.SetText(fmt.Sprintf("%d", app.DefaultRetries))
+
 	// Date format
 	g.dateFormat = widget.NewEntry()
 	g.dateFormat.SetPlaceHolder("YYYYMMDD_HHMMSS")
 
+	// Time zone
+	g.timeZone = widget.NewEntry()
+	g.timeZone.SetPlaceHolder("UTC, auto or Europe/Paris")
+
+	// Name template, previewed live together with the date format and time zone
+	g.nameTemplate = widget.NewEntry()
+	g.nameTemplate.SetPlaceHolder(app.DefaultNameTemplate)
+	g.namePreview = widget.NewLabel("")
+	g.namePreview.Wrapping = fyne.TextWrapWord
+	for _, entry := range []*widget.Entry{g.dateFormat, g.timeZone, g.nameTemplate} {
+		entry.OnChanged = func(string) { g.updateNamePreview() }
+	}
+	g.updateNamePreview()
+
 	// Input row with label
 	inputRow := container.NewBorder(nil, nil, nil, inputBrowse, g.inputFile)
 	inputSection := container.NewVBox(smallLabel("Input File:"), inputRow)
 
+	// Refresh row with label
+	refreshRow := container.NewBorder(nil, nil, nil, refreshBrowse, g.refreshFile)
+	refreshSection := container.NewVBox(smallLabel("Refresh Links From:"), refreshRow)
+
 	// Output row with label
 	outputRow := container.NewBorder(nil, nil, nil, outputBrowse, g.outputDir)
 	outputSection := container.NewVBox(smallLabel("Output Directory:"), outputRow)
 
-	// Settings row (Workers and Date Format)
+	// Settings row (Workers, Retries and Time Zone)
 	workersSection := container.NewVBox(smallLabel("Workers:"), g.workers)
-	dateSection := container.NewVBox(smallLabel("Date Format:"), g.dateFormat)
-	settingsRow := container.NewGridWithColumns(2, workersSection, dateSection)
+	retriesSection := container.NewVBox(smallLabel("Retries:"), g.retries)
+	zoneSection := container.NewVBox(smallLabel("Time Zone:"), g.timeZone)
+	settingsRow := container.NewGridWithColumns(3, workersSection, retriesSection, zoneSection)
+
+	// Date format and file name template with their preview
+	dateSection := container.NewVBox(
+		container.NewGridWithColumns(2,
+			container.NewVBox(smallLabel("Date Format:"), g.dateFormat),
+			container.NewVBox(smallLabel("File Names:"), g.nameTemplate),
+		),
+		g.namePreview,
+	)
 
 	// Options
 	g.skipImageCheck = widget.NewCheck("Image overlays", func(bool) {})
@@ -140,6 +215,12 @@ func (g *GuiApp) createConfigTab() fyne.CanvasObject {
 	g.keepArchCheck = widget.NewCheck("Archive files", func(bool) {})
 	g.keepArchCheck.SetChecked(false)
 
+	g.redownloadChk = widget.NewCheck("Re-download all", func(bool) {})
+	g.redownloadChk.SetChecked(false)
+
+	g.xmpCheck = widget.NewCheck("XMP sidecars", func(bool) {})
+	g.xmpCheck.SetChecked(false)
+
 	g.debugCheck = widget.NewCheck("Debug logging", func(bool) {})
 	g.debugCheck.SetChecked(false)
 
@@ -147,6 +228,8 @@ func (g *GuiApp) createConfigTab() fyne.CanvasObject {
 		g.skipImageCheck,
 		g.skipVideoCheck,
 		g.keepArchCheck,
+		g.redownloadChk,
+		g.xmpCheck,
 		g.debugCheck,
 	)
 
@@ -160,8 +243,14 @@ func (g *GuiApp) createConfigTab() fyne.CanvasObject {
 	})
 	g.startButton.Importance = widget.HighImportance
 
-	// Progress and button on same line
-	progressContainer := container.NewBorder(nil, nil, nil, g.startButton, g.progressBar)
+	// Cancel button, only enabled while processing
+	g.cancelButton = widget.NewButtonWithIcon("Cancel", theme.CancelIcon(), func() {
+		g.cancelProcessing()
+	})
+	g.cancelButton.Disable()
+
+	// Progress and buttons on same line
+	progressContainer := container.NewBorder(nil, nil, nil, container.NewHBox(g.cancelButton, g.startButton), g.progressBar)
 	progressSection := container.NewVBox(
 		g.statusLabel,
 		progressContainer,
@@ -176,10 +265,12 @@ func (g *GuiApp) createConfigTab() fyne.CanvasObject {
 	content := container.NewVBox(
 		createHeader("Input & Output"),
 		inputSection,
+		refreshSection,
 		outputSection,
 		layout.NewSpacer(),
 		createHeader("Configuration"),
 		settingsRow,
+		dateSection,
 		layout.NewSpacer(),
 		createHeader("Options"),
 		optionsRow,
@@ -229,29 +320,75 @@ func (g *GuiApp) startProcessing() {
 	}
 
 	// Validate input
-	if g.inputFile.Text == "" {
+	inputs := g.inputPaths()
+	if len(inputs) == 0 {
 		dialog.ShowError(fmt.Errorf("please select an input file"), g.window)
 		return
 	}
 
-	if _, err := os.Stat(g.inputFile.Text); os.IsNotExist(err) {
-		dialog.ShowError(fmt.Errorf("input file does not exist"), g.window)
+	for _, input := range inputs {
+		if _, err := os.Stat(input); os.IsNotExist(err) {
+			dialog.ShowError(fmt.Errorf("input file %s does not exist", input), g.window)
+			return
+		}
+	}
+	if _, err := app.ParseTimeZone(g.timeZone.Text); err != nil {
+		dialog.ShowError(err, g.window)
+		return
+	}
+	if _, err := app.ParseNameTemplate(g.nameTemplate.Text); err != nil {
+		dialog.ShowError(err, g.window)
 		return
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
 	g.isProcessing = true
 	g.startButton.Disable()
+	g.cancelButton.Enable()
 	g.progressBar.SetValue(0)
 	g.statusLabel.SetText("Starting...")
 	g.tabs.SelectIndex(1) // Switch to logs tab
 
-	go g.processMemories()
+	go g.processMemories(ctx)
+}
+
+// updateNamePreview shows where the configured date format, time zone and
+// name template put an example memory, or why they are invalid.
+func (g *GuiApp) updateNamePreview() {
+	if g.namePreview == nil {
+		return
+	}
+	zone, err := app.ParseTimeZone(g.timeZone.Text)
+	if err != nil {
+		g.namePreview.SetText("Invalid time zone: " + err.Error())
+		return
+	}
+	nameTemplate, err := app.ParseNameTemplate(g.nameTemplate.Text)
+	if err != nil {
+		g.namePreview.SetText("Invalid template: " + err.Error())
+		return
+	}
+	cfg := app.Config{DateFormat: g.dateFormat.Text, TimeZone: zone, NameTemplate: nameTemplate}
+	g.namePreview.SetText("Example: " + app.PreviewName(cfg))
+}
+
+func (g *GuiApp) cancelProcessing() {
+	if !g.isProcessing || g.cancel == nil {
+		return
+	}
+	g.cancelButton.Disable()
+	g.statusLabel.SetText("Cancelling...")
+	g.log("Cancelling, waiting for in-flight downloads to stop...")
+	g.cancel()
 }
 
-func (g *GuiApp) processMemories() {
+func (g *GuiApp) processMemories(ctx context.Context) {
 	defer func() {
+		g.cancel()
 		g.isProcessing = false
 		g.startButton.Enable()
+		g.cancelButton.Disable()
 	}()
 
 	// Parse workers count
@@ -261,86 +398,114 @@ func (g *GuiApp) processMemories() {
 		workers = 1
 	}
 
+	// Parse retries count
+	retries := app.DefaultRetries
+	fmt.Sscanf(g.retries.Text, "%d", &retries)
+	if retries < 0 {
+		retries = 0
+	}
+
+	// Validated by startProcessing.
+	zone, _ := app.ParseTimeZone(g.timeZone.Text)
+	nameTemplate, _ := app.ParseNameTemplate(g.nameTemplate.Text)
+
 	cfg := app.Config{
-		InputFile:        g.inputFile.Text,
+		InputFiles:       g.inputPaths(),
 		OutputDir:        g.outputDir.Text,
 		Concurrency:      workers,
 		SkipImageOverlay: g.skipImageCheck.Checked,
 		SkipVideoOverlay: g.skipVideoCheck.Checked,
 		KeepArchives:     g.keepArchCheck.Checked,
 		DateFormat:       g.dateFormat.Text,
+		TimeZone:         zone,
+		NameTemplate:     nameTemplate,
+		Retries:          retries,
+		Redownload:       g.redownloadChk.Checked,
+		XMP:              g.xmpCheck.Checked,
 	}
 
 	g.log(fmt.Sprintf("Starting download with %d workers", workers))
-	g.log(fmt.Sprintf("Input file: %s", cfg.InputFile))
+	g.log(fmt.Sprintf("Input files: %s", strings.Join(cfg.InputFiles, ", ")))
 	g.log(fmt.Sprintf("Output directory: %s", cfg.OutputDir))
+	g.log(fmt.Sprintf("Time zone: %s", cfg.TimeZone))
 
 	// Read and parse input file
-	content, err := os.ReadFile(cfg.InputFile)
+	g.log("Reading input file...")
+
+	parsed, err := app.LoadInputs(cfg.InputFiles)
 	if err != nil {
-		g.log(fmt.Sprintf("ERROR: Failed to read input file: %v", err))
+		g.log(fmt.Sprintf("ERROR: Failed to parse input file: %v", err))
 		dialog.ShowError(err, g.window)
 		return
 	}
+	for _, w := range parsed.Warnings {
+		g.log(fmt.Sprintf("Skipped %s", w))
+		if g.debugCheck.Checked {
+			g.log("    " + w.Raw)
+		}
+	}
+	g.log(fmt.Sprintf("Parsed input: %s", parsed))
+	memories := parsed.Items
 
-	var memories []app.MemoryItem
-	ext := filepath.Ext(cfg.InputFile)
-
-	g.log(fmt.Sprintf("Parsing %s file...", ext))
+	journal, err := app.OpenJournal(app.JournalPath(cfg.OutputDir))
+	if err != nil {
+		g.log(fmt.Sprintf("ERROR: Failed to open download journal: %v", err))
+		dialog.ShowError(err, g.window)
+		return
+	}
+	defer journal.Close()
+	if n := journal.Len(); n > 0 && !cfg.Redownload {
+		g.log(fmt.Sprintf("Resuming: %d memories recorded by previous runs", n))
+	}
 
-	switch ext {
-	case ".html":
-		memories = app.ParseHTML(string(content))
-	case ".json":
-		memories, err = app.ParseJSON(content)
+	if refreshPath := g.refreshFile.Text; refreshPath != "" {
+		fresh, err := app.LoadInput(refreshPath)
 		if err != nil {
-			g.log(fmt.Sprintf("ERROR: Failed to parse JSON: %v", err))
+			g.log(fmt.Sprintf("ERROR: Failed to parse refresh file: %v", err))
 			dialog.ShowError(err, g.window)
 			return
 		}
-	default:
-		err := fmt.Errorf("unsupported file type: %s", ext)
-		g.log(fmt.Sprintf("ERROR: %v", err))
-		dialog.ShowError(err, g.window)
-		return
+		pending := journal.Pending(memories)
+		refreshed, matched := app.RefreshItems(pending, fresh.Items)
+		memories = app.ReplaceItems(memories, refreshed)
+		g.log(fmt.Sprintf("Refreshed links for %d of %d pending memories from %s", matched, len(pending), refreshPath))
 	}
 
 	total := len(memories)
 	if total == 0 {
-		g.log("No memories found in file")
-		g.statusLabel.SetText("No memories found")
-		dialog.ShowInformation("Complete", "No memories found in the file", g.window)
+		g.log("No memories to download")
+		g.statusLabel.SetText("No memories to download")
+		dialog.ShowInformation("Complete", "No memories to download", g.window)
 		return
 	}
 
 	g.log(fmt.Sprintf("Found %d memories to download", total))
 	g.statusLabel.SetText(fmt.Sprintf("Processing 0/%d", total))
 
-	// Setup worker pool
-	var wg sync.WaitGroup
-	jobs := make(chan app.MemoryItem, total)
-	progressChan := make(chan int, total)
-
-	for w := 1; w <= cfg.Concurrency; w++ {
-		wg.Add(1)
-		go g.worker(jobs, progressChan, &wg, cfg)
-	}
-
-	for _, m := range memories {
-		jobs <- m
-	}
-	close(jobs)
-
-	go func() {
-		wg.Wait()
-		close(progressChan)
-	}()
-
-	// Monitor progress
+	// Process memories with the shared worker pool
+	runner := app.NewRunner(cfg, memories)
+	runner.SetJournal(journal)
 	completed := 0
 	startTime := time.Now()
 
-	for range progressChan {
+	for ev := range runner.Run(ctx) {
+		switch ev.Kind {
+		case app.EventStarted:
+			if g.debugCheck.Checked {
+				g.log(fmt.Sprintf("Processing: %s %s", ev.Item.Type, ev.Item.Date.Format("2006-01-02")))
+			}
+			continue
+		case app.EventFailed:
+			g.log(fmt.Sprintf("ERROR: %v", ev.Err))
+		case app.EventSkipped:
+			if !errors.Is(ev.Err, app.ErrAlreadyDownloaded) || g.debugCheck.Checked {
+				g.log(fmt.Sprintf("Skipped: %v", ev.Err))
+			}
+		case app.EventCompleted:
+		default:
+			continue
+		}
+
 		completed++
 		progress := float64(completed) / float64(total)
 		g.progressBar.SetValue(progress)
@@ -361,22 +526,28 @@ func (g *GuiApp) processMemories() {
 		}
 	}
 
-	g.log(fmt.Sprintf("Download complete! Processed %d memories in %s", total, time.Since(startTime).Round(time.Second)))
-	g.statusLabel.SetText(fmt.Sprintf("Complete: %d/%d", total, total))
+	summary := runner.Summary()
+	if ctx.Err() != nil {
+		g.log(fmt.Sprintf("Cancelled after %s: %s", time.Since(startTime).Round(time.Second), summary))
+		g.statusLabel.SetText(fmt.Sprintf("Cancelled: %d/%d succeeded", summary.Succeeded, total))
+		return
+	}
+	g.log(fmt.Sprintf("Download complete! Processed %d memories in %s: %s", total, time.Since(startTime).Round(time.Second), summary))
+	g.statusLabel.SetText(fmt.Sprintf("Complete: %d/%d succeeded", summary.Succeeded, total))
 	g.progressBar.SetValue(1.0)
 
-	dialog.ShowInformation("Complete", fmt.Sprintf("Successfully downloaded %d memories!", total), g.window)
-}
-
-func (g *GuiApp) worker(jobs <-chan app.MemoryItem, progress chan<- int, wg *sync.WaitGroup, cfg app.Config) {
-	defer wg.Done()
-	for item := range jobs {
-		if g.debugCheck.Checked {
-			g.log(fmt.Sprintf("Processing: %s %s", item.Type, item.Date.Format("2006-01-02")))
-		}
-		app.ProcessItem(item, cfg)
-		progress <- 1
+	if summary.Expired > 0 {
+		g.log(fmt.Sprintf("%d links expired: request a new export and select it under \"Refresh Links From\", then start again", summary.Expired))
+	}
+	var unreadable string
+	if n := len(parsed.Warnings); n > 0 {
+		unreadable = fmt.Sprintf("\n%d entries of the export could not be read. See the log for details.", n)
+	}
+	if summary.Failed > 0 || summary.Expired > 0 {
+		dialog.ShowInformation("Complete with errors", fmt.Sprintf("Downloaded %d of %d memories (%d failed, %d expired, %d skipped). See the log for details.%s", summary.Succeeded, total, summary.Failed, summary.Expired, summary.Skipped, unreadable), g.window)
+		return
 	}
+	dialog.ShowInformation("Complete", fmt.Sprintf("Successfully downloaded %d memories! (%d skipped)%s", summary.Succeeded, summary.Skipped, unreadable), g.window)
 }
 
 // Modern theme with optimized font sizes
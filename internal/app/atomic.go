@@ -0,0 +1,89 @@
+package app
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// outputPerm is the permission of files written to the output directory.
+const outputPerm = 0644
+
+// writeAtomic creates the file at path with write, which is given the path of
+// a hidden temporary file next to it to fill. Once write succeeds the file is
+// synced to disk and renamed over path, so path only ever holds complete
+// content: after a crash or an error it is missing or unchanged. The
+// temporary file keeps the extension of path for tools such as ffmpeg that
+// choose the format from it.
+func writeAtomic(path string, write func(tmpPath string) error) error {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	f, err := os.CreateTemp(filepath.Clean(dir), "."+strings.TrimSuffix(base, ext)+".*.tmp"+ext)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	f.Close()
+
+	if err := write(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, outputPerm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := syncRename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes the content produced by write to path, see writeAtomic.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	return writeAtomic(path, func(tmpPath string) error {
+		f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_TRUNC, outputPerm)
+		if err != nil {
+			return err
+		}
+		if err := write(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+}
+
+// syncRename moves the complete file at src to path. The file is synced first
+// so the rename cannot reach the disk before its content does, and the
+// directory afterwards so the rename itself survives a crash.
+func syncRename(src, path string) error {
+	// Windows only syncs files opened for writing.
+	f, err := os.OpenFile(src, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(src, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir flushes a directory's entries to disk. It is best effort: not every
+// platform can sync directories.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
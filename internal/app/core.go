@@ -3,127 +3,137 @@ package app
 import (
 	"archive/zip"
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 )
 
 // Config holds the application's configuration settings.
 type Config struct {
-	InputFile        string
+	InputFiles       []string
 	OutputDir        string
 	Concurrency      int
 	SkipImageOverlay bool
 	SkipVideoOverlay bool
 	KeepArchives     bool
 	DateFormat       string
+	// NameTemplate lays out the paths of memories in OutputDir.
+	NameTemplate NameTemplate
+	// TimeZone is the time zone of the folders, file names and EXIF dates.
+	TimeZone TimeZone
+	// XMP writes the metadata of every memory to an XMP sidecar next to it,
+	// and embeds it in JPEG images, for photo managers that read XMP.
+	XMP bool
+	// Redownload ignores the journal's completed items and downloads everything again.
+	Redownload bool
+
+	// Retries is the number of times a failed download is retried when the
+	// failure looks transient (network errors, 408, 429 and 5xx responses).
+	Retries int
+	// RetryBaseDelay is the backoff before the first retry; it doubles on every
+	// further attempt, with jitter, up to RetryMaxDelay.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// Resolver turns download links into media URLs; PostLinkResolver when nil.
+	Resolver URLResolver
 }
 
 // MemoryItem represents a single memory item extracted from the HTML file.
 type MemoryItem struct {
 	Date      time.Time
 	Type      string
-	Latitude  string
-	Longitude string
+	Location  Location
 	URL       string
 	Extension string
+	// Media is the kind of media, from the export's label until the
+	// download is inspected.
+	Media MediaType
+	// DownloadLink is the indirect link that must be resolved, see URLResolver,
+	// into a short-lived media URL. It is used when URL is missing or expired.
+	DownloadLink string
+	// ID identifies the memory across runs and exports, see NewItemID.
+	ID string
+	// Bundled is set when the media was included in the export ZIP the item
+	// was read from; it is then extracted instead of downloaded.
+	Bundled *BundledMedia
+	// Fallbacks are the links other exports give for the memory, tried in
+	// turn when its own fail, see MergeResults.
+	Fallbacks []ItemLinks
 }
 
-// jsonMemoryItem is a helper struct for unmarshaling JSON input.
-type jsonMemoryItem struct {
-	Date             string `json:"Date"`
-	MediaType        string `json:"Media Type"`
-	Location         string `json:"Location"`
-	DownloadLink     string `json:"Download Link"`
-	MediaDownloadUrl string `json:"Media Download Url"`
+// ItemLinks are the means one export gives to obtain a memory's media.
+type ItemLinks struct {
+	URL          string
+	DownloadLink string
+	Bundled      *BundledMedia
 }
 
-// jsonInput is a helper struct for unmarshaling the overall JSON structure.
-type jsonInput struct {
-	SavedMedia []jsonMemoryItem `json:"Saved Media"`
+// ErrNoURL is returned for memory items that have no download URL.
+var ErrNoURL = errors.New("no download URL")
+
+// String identifies the memory item by its type and capture time.
+func (m MemoryItem) String() string {
+	return fmt.Sprintf("%s %s", m.Type, m.Date.Format("2006-01-02 15:04:05"))
 }
 
-// ParseHTML extracts memory items from the HTML content.
-func ParseHTML(html string) []MemoryItem {
-	var items []MemoryItem
-	rowRegex := regexp.MustCompile(`(?s)<tr>(.*?)</tr>`)
-	colRegex := regexp.MustCompile(`(?s)<td>(.*?)</td>`)
-	gpsRegex := regexp.MustCompile(`([-+]?\d*\.\d+|\d+)`)
-	urlRegex := regexp.MustCompile(`downloadMemories\('([^']+)'`)
-	rows := rowRegex.FindAllStringSubmatch(html, -1)
-	for _, rowMatch := range rows {
-		cols := colRegex.FindAllStringSubmatch(rowMatch[1], -1)
-		if len(cols) < 4 {
-			continue
-		}
-		dateStr := strings.Replace(StripTags(cols[0][1]), " UTC", "", 1)
-		t, err := time.Parse("2006-01-02 15:04:05", dateStr)
-		if err != nil {
-			continue
-		}
-		mType := StripTags(cols[1][1])
-		ext := ".jpg"
-		if strings.Contains(mType, "Video") {
-			ext = ".mp4"
-		}
-		gpsStr := StripTags(cols[2][1])
-		gps := gpsRegex.FindAllString(gpsStr, -1)
-		lat, lon := "", ""
-		if len(gps) >= 2 {
-			lat, lon = gps[0], gps[1]
-		}
-		urlMatch := urlRegex.FindStringSubmatch(cols[3][1])
-		if len(urlMatch) < 2 {
-			continue
-		}
-		items = append(items, MemoryItem{Date: t, Type: strings.TrimSpace(mType), Latitude: lat, Longitude: lon, URL: urlMatch[1], Extension: ext})
-	}
-	return items
+// ParseWarning describes an input row that could not be turned into a MemoryItem.
+type ParseWarning struct {
+	Source string // input file the row was read from, when known
+	Row    int    // 1-based number of the entry among the memories, headers excluded
+	Raw    string // the row as found in the input, for inspection
+	Reason string
 }
 
-// ParseJSON extracts memory items from JSON content.
-func ParseJSON(jsonData []byte) ([]MemoryItem, error) {
-	var input jsonInput
-	if err := json.Unmarshal(jsonData, &input); err != nil {
-		return nil, fmt.Errorf("error unmarshaling JSON: %w", err)
+// String formats the warning for logs.
+func (w ParseWarning) String() string {
+	if w.Source != "" {
+		return fmt.Sprintf("%s row %d: %s", filepath.Base(w.Source), w.Row, w.Reason)
 	}
+	return fmt.Sprintf("row %d: %s", w.Row, w.Reason)
+}
 
-	var items []MemoryItem
-	gpsRegex := regexp.MustCompile(`([-+]?\d*\.\d+|\d+)`)
-	for _, jItem := range input.SavedMedia {
-		t, err := time.Parse("2006-01-02 15:04:05 UTC", jItem.Date)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing date '%s': %w", jItem.Date, err)
-		}
+// ParseResult holds the memory items read from an export together with the
+// rows that had to be skipped.
+type ParseResult struct {
+	Items    []MemoryItem
+	Warnings []ParseWarning
+	// Duplicates counts the items dropped because another input holds the same memory.
+	Duplicates int
+}
 
-		ext := ".jpg"
-		if strings.Contains(jItem.MediaType, "Video") {
-			ext = ".mp4"
-		}
+// String formats the result for logs, e.g. "9812 parsed, 14 skipped".
+func (r ParseResult) String() string {
+	str := fmt.Sprintf("%d parsed, %d skipped", len(r.Items), len(r.Warnings))
+	if r.Duplicates > 0 {
+		str += fmt.Sprintf(", %d duplicates", r.Duplicates)
+	}
+	if n := r.Bundled(); n > 0 {
+		str += fmt.Sprintf(", %d included in the export", n)
+	}
+	return str
+}
 
-		gps := gpsRegex.FindAllString(jItem.Location, -1)
-		lat, lon := "", ""
-		if len(gps) >= 2 {
-			lat, lon = gps[0], gps[1]
+// Bundled returns the number of items whose media is included in the export.
+func (r ParseResult) Bundled() int {
+	n := 0
+	for _, item := range r.Items {
+		if item.Bundled != nil {
+			n++
 		}
-
-		items = append(items, MemoryItem{
-			Date:      t,
-			Type:      strings.TrimSpace(jItem.MediaType),
-			Latitude:  lat,
-			Longitude: lon,
-			URL:       jItem.MediaDownloadUrl,
-			Extension: ext,
-		})
 	}
-	return items, nil
+	return n
+}
+
+// warn records a row that could not be parsed.
+func (r *ParseResult) warn(row int, raw, reason string) {
+	r.Warnings = append(r.Warnings, ParseWarning{Row: row, Raw: strings.Join(strings.Fields(raw), " "), Reason: reason})
 }
 
 // StripTags removes HTML tags from a string.
@@ -131,84 +141,204 @@ func StripTags(input string) string {
 	return regexp.MustCompile(`<[^>]*>`).ReplaceAllString(input, "")
 }
 
-// DownloadFile downloads a file from the given URL and returns its content.
-func DownloadFile(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+// HandleZip processes a ZIP archive on disk containing media and overlays.
+func HandleZip(ctx context.Context, archivePath, targetPath string, item MemoryItem, config Config) error {
+	item.Media = labelMedia(item)
+	_, err := handleZip(ctx, archivePath, targetPath, item, config)
+	return err
+}
+
+// handleZip writes the media contained in a ZIP archive to targetPath and
+// reports whether an overlay was merged onto it. Entries are streamed from
+// disk so memory use does not grow with the size of the media.
+func handleZip(ctx context.Context, archivePath, targetPath string, item MemoryItem, config Config) (bool, error) {
+	reader, err := zip.OpenReader(archivePath)
 	if err != nil {
-		return nil, err
+		return false, fmt.Errorf("error opening archive: %w", err)
 	}
-	defer resp.Body.Close()
+	defer reader.Close()
 
-	return io.ReadAll(resp.Body)
+	base, overlay := mediaEntries(reader.File)
+	if base == nil {
+		return false, errors.New("archive contains no main media file")
+	}
+	if overlay == nil {
+		return false, extractZipFile(base, targetPath)
+	}
+	// Overlays are dropped when skipped by the configuration or when the
+	// image format cannot be decoded.
+	c, err := zipEntryContainer(base)
+	if err != nil {
+		return false, err
+	}
+	if !mergesOverlay(item, c, config) {
+		return false, extractZipFile(base, targetPath)
+	}
+
+	switch item.Media {
+	case MediaImage:
+		if err := mergeZippedImages(base, overlay, targetPath); err != nil {
+			return false, fmt.Errorf("error merging image overlay: %w", err)
+		}
+		return true, nil
+	case MediaVideo:
+		if err := mergeZippedVideos(ctx, base, overlay, targetPath, config); err != nil {
+			return false, fmt.Errorf("error merging video overlay: %w", err)
+		}
+		return true, nil
+	}
+	return false, extractZipFile(base, targetPath)
 }
 
-// HandleZip processes a ZIP archive containing media and overlays.
-func HandleZip(data []byte, targetPath string, item MemoryItem, config Config) {
-	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+// extractZipFile streams a single archive entry to path, see writeFileAtomic.
+func extractZipFile(file *zip.File, path string) error {
+	rc, err := file.Open()
 	if err != nil {
-		return
-	}
-	var baseData, overlayData []byte
-	var bName, oName string
-	for _, file := range reader.File {
-		buf := new(bytes.Buffer)
-		f, _ := file.Open()
-		io.Copy(buf, f)
-		f.Close()
-		if strings.Contains(file.Name, "-overlay") {
-			overlayData, oName = buf.Bytes(), file.Name
-		} else if strings.Contains(file.Name, "-main") {
-			baseData, bName = buf.Bytes(), file.Name
+		return fmt.Errorf("error opening %s in archive: %w", file.Name, err)
+	}
+	defer rc.Close()
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		if _, err := io.Copy(w, rc); err != nil {
+			return fmt.Errorf("error reading %s from archive: %w", file.Name, err)
 		}
+		return nil
+	})
+}
+
+// mergeZippedImages decodes the base image and overlay straight from the archive and merges them.
+func mergeZippedImages(base, overlay *zip.File, outPath string) error {
+	bg, err := base.Open()
+	if err != nil {
+		return err
 	}
-	if baseData == nil {
-		return
+	defer bg.Close()
+	ov, err := overlay.Open()
+	if err != nil {
+		return err
 	}
+	defer ov.Close()
+	return mergeImages(bg, ov, outPath)
+}
 
-	// Check skip flags based on media type
-	skipOverlay := (item.Extension == ".jpg" && config.SkipImageOverlay) ||
-		(item.Extension == ".mp4" && config.SkipVideoOverlay)
-
-	if skipOverlay {
-		os.WriteFile(targetPath, baseData, 0644)
-		return
+// mergeZippedVideos extracts the base video and overlay to the temp directory
+// so ffmpeg can read them, then merges them.
+func mergeZippedVideos(ctx context.Context, base, overlay *zip.File, outPath string, config Config) error {
+	tmpDir, err := os.MkdirTemp(tempDir(config), "merge-")
+	if err != nil {
+		return err
 	}
+	defer os.RemoveAll(tmpDir)
 
-	if item.Extension == ".jpg" && overlayData != nil {
-		mergeImages(baseData, overlayData, targetPath)
-	} else if item.Extension == ".mp4" && overlayData != nil {
-		mergeVideos(baseData, overlayData, bName, oName, targetPath)
-	} else {
-		os.WriteFile(targetPath, baseData, 0644)
+	bTmp, oTmp := filepath.Join(tmpDir, filepath.Base(base.Name)), filepath.Join(tmpDir, filepath.Base(overlay.Name))
+	if err := extractZipFile(base, bTmp); err != nil {
+		return err
 	}
+	if err := extractZipFile(overlay, oTmp); err != nil {
+		return err
+	}
+	return mergeVideos(ctx, bTmp, oTmp, outPath)
 }
 
 // ProcessItem handles the downloading, processing, and saving of a single memory item.
-func ProcessItem(item MemoryItem, config Config) {
-	data, err := DownloadFile(item.URL)
-	if err != nil {
-		return
-	}
+// Cancelling ctx aborts in-flight downloads and ffmpeg jobs.
+func ProcessItem(ctx context.Context, item MemoryItem, config Config) error {
+	_, err := processItem(ctx, item, nameValues{}, config, nil)
+	return err
+}
 
-	year, month := item.Date.Format("2006"), item.Date.Format("01")
+// processItem runs a memory item through the pipeline, reporting each stage to
+// emit when it is non-nil, and returns the path of the output file. names
+// holds the item's position in the input and its collision suffix, see Runner.
+// Returned errors are wrapped with the item's identity and the failing stage.
+// The output is completed, metadata included, in a temporary file that is
+// renamed into place last, so a failure or a crash leaves any file a previous
+// run saved under the same name in place and never an output without its
+// metadata.
+func processItem(ctx context.Context, item MemoryItem, names nameValues, config Config, emit func(EventKind, string)) (string, error) {
+	if emit == nil {
+		emit = func(EventKind, string) {}
+	}
 
-	// Use custom date format if provided
-	dateStr := item.Date.Format("02-Jan-2006 15-04-05")
-	if config.DateFormat != "" {
-		dateStr = FormatDateCustom(item.Date, config.DateFormat)
+	item.ID = itemID(item)
+	tmpPath, err := fetchItem(ctx, item, config)
+	if errors.Is(err, ErrNoURL) {
+		return "", fmt.Errorf("%s: %w", item, err)
+	} else if err != nil {
+		return "", fmt.Errorf("%s: download: %w", item, err)
 	}
+	defer removePart(tmpPath)
+	emit(EventDownloaded, "")
 
-	fileBase := fmt.Sprintf("%s %s", item.Type, dateStr)
-	fileName := fileBase + item.Extension
+	zipped, err := isZipFile(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("%s: download: %w", item, err)
+	}
+	overlay, err := detectMedia(&item, tmpPath, zipped, config)
+	if err != nil {
+		return "", fmt.Errorf("%s: download: %w", item, err)
+	}
 
-	var finalPath string
-	if IsZip(data) {
-		finalPath = handleZippedItem(item, data, config, year, month, fileBase, fileName)
-	} else {
-		finalPath = handleRegularItem(item, data, config, year, month, fileName)
+	// Folders and names use the local time of the memory, not the export's UTC.
+	local := config.TimeZone.LocalTime(item)
+	names.local, names.overlay, names.dateFormat = local, overlay, config.DateFormat
+	name := filepath.FromSlash(config.NameTemplate.path(item, names))
+	finalPath := filepath.Join(config.OutputDir, name)
+	if zipped {
+		finalPath = filepath.Join(config.OutputDir, filepath.FromSlash(overlayFolder(item.Media)), name)
+	}
+	if err := os.MkdirAll(filepath.Dir(finalPath), os.ModePerm); err != nil {
+		return "", fmt.Errorf("%s: save: %w", item, err)
 	}
 
-	applyMetadata(finalPath, item)
+	stage := "save"
+	var merged, sidecar bool
+	err = writeAtomic(finalPath, func(outPath string) error {
+		if zipped {
+			stage = "extract"
+			m, err := handleZip(ctx, tmpPath, outPath, item, config)
+			if err != nil {
+				return err
+			}
+			if merged = m; merged {
+				emit(EventMerged, finalPath)
+			}
+			if config.KeepArchives {
+				stage = "keep archive"
+				if err := keepArchive(tmpPath, item, config, name); err != nil {
+					return err
+				}
+			}
+		} else if err := os.Rename(tmpPath, outPath); err != nil {
+			return err
+		}
+
+		stage = "metadata"
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := applyMetadata(outPath, item, local, merged, config); err != nil {
+			return err
+		}
+		if config.XMP {
+			sidecar = true
+			if err := writeXMPSidecar(finalPath, item, local, merged); err != nil {
+				return err
+			}
+		}
+		stage = "save"
+		return nil
+	})
+	if err != nil {
+		if sidecar {
+			for _, p := range xmpSidecarPaths(finalPath) {
+				os.Remove(p)
+			}
+		}
+		return "", fmt.Errorf("%s: %s: %w", item, stage, err)
+	}
+	emit(EventMetadataApplied, finalPath)
+	return finalPath, nil
 }
 
 // FormatDateCustom formats a time according to a custom format string.
@@ -242,42 +372,62 @@ func IsZip(data []byte) bool {
 	return len(data) > 4 && bytes.HasPrefix(data, []byte("PK\x03\x04"))
 }
 
-// handleZippedItem processes a memory item that is a ZIP archive.
-func handleZippedItem(item MemoryItem, data []byte, config Config, year, month, fileBase, fileName string) string {
-	overlayTypeDir := "images"
-	if item.Extension == ".mp4" {
-		overlayTypeDir = "videos"
+// isZipFile sniffs the first bytes of the file at path for the ZIP magic.
+func isZipFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
 	}
+	defer f.Close()
 
-	if config.KeepArchives {
-		archiveFolder := filepath.Join(config.OutputDir, "overlays", "archives", year, month)
-		os.MkdirAll(archiveFolder, os.ModePerm)
-		os.WriteFile(filepath.Join(archiveFolder, fileBase+".zip"), data, 0644)
+	header := make([]byte, 8)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
 	}
+	return IsZip(header[:n]), nil
+}
 
-	subFolder := filepath.Join(config.OutputDir, "overlays", overlayTypeDir, year, month)
-	os.MkdirAll(subFolder, os.ModePerm)
-	finalPath := filepath.Join(subFolder, fileName)
-	HandleZip(data, finalPath, item, config)
-	return finalPath
+// keepArchive moves the downloaded archive of a memory saved at name to the
+// archives folder, next to the overlay folders.
+func keepArchive(archivePath string, item MemoryItem, config Config, name string) error {
+	keptPath := filepath.Join(config.OutputDir, "overlays", "archives", strings.TrimSuffix(name, item.Extension)+".zip")
+	if err := os.MkdirAll(filepath.Dir(keptPath), os.ModePerm); err != nil {
+		return err
+	}
+	return syncRename(archivePath, keptPath)
 }
 
-// handleRegularItem processes a memory item that is not a ZIP archive.
-func handleRegularItem(item MemoryItem, data []byte, config Config, year, month, fileName string) string {
-	subFolder := filepath.Join(config.OutputDir, year, month)
-	os.MkdirAll(subFolder, os.ModePerm)
-	finalPath := filepath.Join(subFolder, fileName)
-	os.WriteFile(finalPath, data, 0644)
-	return finalPath
+// overlayFolder returns the slash-separated folder, relative to the output
+// directory, of memories of the media type downloaded as ZIP archives.
+func overlayFolder(media MediaType) string {
+	if media == MediaVideo {
+		return "overlays/videos"
+	}
+	return "overlays/images"
 }
 
-// applyMetadata applies EXIF data to the processed file.
-func applyMetadata(path string, item MemoryItem) {
-	if item.Extension == ".jpg" {
-		lat, _ := strconv.ParseFloat(item.Latitude, 64)
-		lon, _ := strconv.ParseFloat(item.Longitude, 64)
-		_ = updateNativeExif(path, lat, lon, item.Date)
+// applyMetadata records the memory's capture time and location in the
+// processed file: as EXIF data in JPEG images, dated at the local capture
+// time, and in the movie header of MP4 and QuickTime videos. With
+// Config.XMP it is also embedded as XMP in JPEG images, before their EXIF
+// data sets the file times. The XMP sidecar is written by processItem, next
+// to the final path.
+func applyMetadata(path string, item MemoryItem, local time.Time, merged bool, config Config) error {
+	if config.XMP && item.Extension == ".jpg" {
+		if err := embedXMP(path, item, local, merged); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch {
+	case item.Extension == ".jpg":
+		err = updateNativeExif(path, item.Location, local)
+	case item.Media == MediaVideo:
+		err = updateVideoMetadata(path, item.Location, local)
 	}
+	return err
 }
 
 // PrintProgress displays a progress bar in the console.
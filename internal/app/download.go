@@ -0,0 +1,379 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default backoff settings used when the Config leaves them unset.
+const (
+	DefaultRetries        = 3
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// errRestartDownload is returned when a partial download cannot be resumed
+// and has been discarded; retrying starts it again from zero.
+var errRestartDownload = errors.New("server did not honour the resume request, restarting download")
+
+// ErrExpired matches download errors caused by a signed URL that has expired.
+// A fresh export is needed to obtain new links for such items.
+var ErrExpired = errors.New("download link expired")
+
+// HTTPError is returned when the server answers a download with a non-2xx status.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is the delay requested by the server's Retry-After header, if any.
+	RetryAfter time.Duration
+	// Expired is set when the response shows that the signed URL has expired.
+	Expired bool
+}
+
+// Error implements the error interface.
+func (e *HTTPError) Error() string {
+	if e.Expired {
+		return fmt.Sprintf("%s (HTTP status %s)", ErrExpired, e.Status)
+	}
+	return fmt.Sprintf("unexpected HTTP status %s", e.Status)
+}
+
+// Is makes errors.Is(err, ErrExpired) report expired links.
+func (e *HTTPError) Is(target error) bool {
+	return target == ErrExpired && e.Expired
+}
+
+// Temporary reports whether the request may succeed if it is retried later.
+// Client errors such as 403 (expired link) or 404 are permanent.
+func (e *HTTPError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	}
+	return e.StatusCode >= 500
+}
+
+// IsTransient reports whether a download error is worth retrying.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Temporary()
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errRestartDownload) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// DownloadFile downloads a file from the given URL and returns its content.
+// The whole body is held in memory; media is streamed to disk with resumable
+// downloads by ProcessItem and the Runner instead.
+// Responses with a non-2xx status are returned as an *HTTPError.
+func DownloadFile(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// tempDir returns the directory inside the output tree that holds in-progress
+// downloads, so finished files can be renamed into place on the same filesystem.
+func tempDir(config Config) string {
+	return filepath.Join(config.OutputDir, ".tmp")
+}
+
+// partMeta is stored next to a .part file and records what is needed to
+// resume it with a Range request.
+type partMeta struct {
+	AcceptRanges bool   `json:"accept_ranges"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+}
+
+// validator returns the value to send in If-Range, preferring the strong ETag.
+func (m partMeta) validator() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// partPaths returns the .part file and its metadata sidecar for an item ID.
+func partPaths(config Config, id string) (string, string) {
+	part := filepath.Join(tempDir(config), id+".part")
+	return part, part + ".json"
+}
+
+// removePart deletes a .part file and its metadata.
+func removePart(partPath string) {
+	os.Remove(partPath)
+	os.Remove(partPath + ".json")
+}
+
+// downloadPart downloads url into the item's .part file in the temp directory
+// and returns its path. Transient failures are retried and resume from the
+// bytes already on disk; the .part file is kept when the download is
+// interrupted so a later run can resume it too. The caller is responsible for
+// removing or renaming the file once it is complete.
+func downloadPart(ctx context.Context, url, id string, config Config) (string, error) {
+	if err := os.MkdirAll(tempDir(config), os.ModePerm); err != nil {
+		return "", err
+	}
+	partPath, metaPath := partPaths(config, id)
+
+	err := withRetry(ctx, config, func() error {
+		return resumeDownload(ctx, url, partPath, metaPath)
+	})
+	if err != nil {
+		if !IsTransient(err) && ctx.Err() == nil {
+			removePart(partPath)
+		}
+		return "", err
+	}
+	return partPath, nil
+}
+
+// resumeDownload continues downloading url into partPath. When part of the
+// file is already on disk and the server advertised byte ranges, it sends a
+// Range request guarded by If-Range, so a changed file is sent in full and
+// the download restarts from zero.
+func resumeDownload(ctx context.Context, url, partPath, metaPath string) error {
+	var offset int64
+	var meta partMeta
+	if info, err := os.Stat(partPath); err == nil && info.Size() > 0 {
+		if data, err := os.ReadFile(metaPath); err == nil && json.Unmarshal(data, &meta) == nil &&
+			meta.AcceptRanges && meta.validator() != "" {
+			offset = info.Size()
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", meta.validator())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			// Not the range we asked for: drop what we have and start over.
+			removePart(partPath)
+			return errRestartDownload
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		if total, ok := contentRangeTotal(resp.Header.Get("Content-Range")); ok && total == offset {
+			return nil
+		}
+		removePart(partPath)
+		return errRestartDownload
+	default:
+		if err := checkStatus(resp); err != nil {
+			return err
+		}
+		meta = partMeta{
+			AcceptRanges: strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes"),
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			ContentType:  resp.Header.Get("Content-Type"),
+		}
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(metaPath, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// contentRangeStart parses the first byte position of a "bytes start-end/total" header.
+func contentRangeStart(header string) (int64, bool) {
+	rest, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	startStr, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	return start, err == nil
+}
+
+// contentRangeTotal parses the complete length from a "bytes */total" header.
+func contentRangeTotal(header string) (int64, bool) {
+	_, totalStr, ok := strings.Cut(header, "/")
+	if !ok || totalStr == "*" {
+		return 0, false
+	}
+	total, err := strconv.ParseInt(totalStr, 10, 64)
+	return total, err == nil
+}
+
+// checkStatus returns an *HTTPError for responses that do not carry the requested file.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		Expired:    isExpiryResponse(resp, time.Now()),
+	}
+}
+
+// isExpiryResponse reports whether a rejected download failed because its
+// signed URL expired, judging from the status, the error body and the expiry
+// parameters of the URL itself.
+func isExpiryResponse(resp *http.Response, now time.Time) bool {
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusGone:
+	default:
+		return false
+	}
+	if resp.StatusCode == http.StatusGone {
+		return true
+	}
+	if resp.Request != nil && urlExpired(resp.Request.URL, now) {
+		return true
+	}
+
+	// S3 ("Request has expired"), GCS ("ExpiredToken") and CloudFront all
+	// mention the expiry in their error bodies.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return strings.Contains(strings.ToLower(string(body)), "expired")
+}
+
+// urlExpired reports whether the expiry encoded in a signed URL lies in the
+// past. It understands AWS (X-Amz-Date + X-Amz-Expires), CloudFront and
+// Google V2 (Expires as Unix seconds) style signatures.
+func urlExpired(u *url.URL, now time.Time) bool {
+	query := u.Query()
+	if date, expires := query.Get("X-Amz-Date"), query.Get("X-Amz-Expires"); date != "" && expires != "" {
+		signed, err := time.Parse("20060102T150405Z", date)
+		secs, serr := strconv.Atoi(expires)
+		if err == nil && serr == nil {
+			return now.After(signed.Add(time.Duration(secs) * time.Second))
+		}
+	}
+	for _, key := range []string{"Expires", "expires"} {
+		if unix, err := strconv.ParseInt(query.Get(key), 10, 64); err == nil && unix > 1e9 {
+			return now.After(time.Unix(unix, 0))
+		}
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// withRetry calls fn until it succeeds, retrying transient failures with
+// jittered exponential backoff as configured in config.
+func withRetry(ctx context.Context, config Config, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= config.Retries || !IsTransient(err) || ctx.Err() != nil {
+			if attempt > 0 {
+				return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+			}
+			return err
+		}
+
+		timer := time.NewTimer(retryDelay(attempt, err, config))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDelay computes the wait before retry number attempt+1. It picks a random
+// delay in the upper half of an exponentially growing window and never waits
+// less than the server's Retry-After.
+func retryDelay(attempt int, err error, config Config) time.Duration {
+	base, maxDelay := config.RetryBaseDelay, config.RetryMaxDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+
+	window := maxDelay
+	if attempt < 30 && base<<attempt < maxDelay {
+		window = base << attempt
+	}
+	delay := window/2 + rand.N(window/2+1)
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > delay {
+		delay = httpErr.RetryAfter
+	}
+	return delay
+}
@@ -0,0 +1,273 @@
+package app
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BundledFile is a file inside one of the parts of a Snapchat export ZIP.
+type BundledFile struct {
+	Archive string // path of the export ZIP on disk
+	Name    string // name of the entry inside the archive
+}
+
+// BundledMedia locates the media of a memory that was included in the export
+// itself, so it does not need to be downloaded.
+type BundledMedia struct {
+	Main    BundledFile
+	Overlay BundledFile // zero when the memory has no overlay
+}
+
+// memoriesFileNames lists the memories files of an export, in order of preference:
+// the JSON file also carries the direct media URLs.
+var memoriesFileNames = []string{"memories_history.json", "memories_history.html"}
+
+// exportParts returns the export ZIP at path together with the other parts of
+// a split export. Snapchat names every part of an export after the same
+// request timestamp, "mydata~<timestamp>", so the parts are the sibling ZIP
+// files sharing that prefix.
+func exportParts(archivePath string) ([]string, error) {
+	dir, base := filepath.Split(archivePath)
+	prefix := exportPrefix(base)
+	if prefix == "" {
+		return []string{archivePath}, nil
+	}
+
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var parts []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && exportPrefix(name) == prefix && strings.EqualFold(filepath.Ext(name), ".zip") {
+			parts = append(parts, filepath.Join(dir, name))
+		}
+	}
+	if len(parts) == 0 {
+		return []string{archivePath}, nil
+	}
+	sort.Strings(parts)
+	return parts, nil
+}
+
+// exportPrefix returns the "mydata~<timestamp>" prefix of an export file name,
+// or "" for other file names.
+func exportPrefix(name string) string {
+	const marker = "mydata~"
+	if len(name) < len(marker) || !strings.EqualFold(name[:len(marker)], marker) {
+		return ""
+	}
+	end := len(marker)
+	for end < len(name) && name[end] >= '0' && name[end] <= '9' {
+		end++
+	}
+	if end == len(marker) {
+		return ""
+	}
+	return strings.ToLower(name[:end])
+}
+
+// ParseExportZip reads a Snapchat "mydata" export ZIP, including the other
+// parts of a split export next to it. It parses the memories file found in
+// the parts and attaches the media bundled in the export to their items.
+func ParseExportZip(archivePath string) (ParseResult, error) {
+	parts, err := exportParts(archivePath)
+	if err != nil {
+		return ParseResult{}, err
+	}
+
+	var memoriesFile *zip.File
+	var rank int
+	bundled := make(map[string]*BundledMedia)
+	for _, part := range parts {
+		reader, err := zip.OpenReader(part)
+		if err != nil {
+			return ParseResult{}, fmt.Errorf("error opening %s: %w", filepath.Base(part), err)
+		}
+		defer reader.Close()
+
+		for _, file := range reader.File {
+			base := strings.ToLower(path.Base(file.Name))
+			for i, name := range memoriesFileNames {
+				if base == name && (memoriesFile == nil || i < rank) {
+					memoriesFile, rank = file, i
+				}
+			}
+			indexBundledFile(bundled, part, file.Name)
+		}
+	}
+	if memoriesFile == nil {
+		return ParseResult{}, fmt.Errorf("no %s found in %s", strings.Join(memoriesFileNames, " or "), filepath.Base(archivePath))
+	}
+
+	content, err := readZipFile(memoriesFile)
+	if err != nil {
+		return ParseResult{}, err
+	}
+	var result ParseResult
+	if strings.HasSuffix(strings.ToLower(memoriesFile.Name), ".json") {
+		if result, err = ParseJSON(content); err != nil {
+			return ParseResult{}, err
+		}
+	} else {
+		result = ParseHTML(string(content))
+	}
+
+	for i, item := range result.Items {
+		if media, ok := bundled[mediaID(item)]; ok && media.Main.Name != "" {
+			result.Items[i].Bundled = media
+		}
+	}
+	return result, nil
+}
+
+// indexBundledFile records name in bundled when it is a memory's media file.
+// Exports name them "memories/<date>_<media id>-main.<ext>" and
+// "memories/<date>_<media id>-overlay.<ext>".
+func indexBundledFile(bundled map[string]*BundledMedia, archive, name string) {
+	if !strings.Contains(strings.ToLower(name), "memories/") {
+		return
+	}
+	base := path.Base(name)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	if _, rest, ok := strings.Cut(base, "_"); ok {
+		base = rest
+	}
+
+	var id string
+	var overlay bool
+	switch {
+	case strings.HasSuffix(base, "-main"):
+		id = strings.TrimSuffix(base, "-main")
+	case strings.HasSuffix(base, "-overlay"):
+		id, overlay = strings.TrimSuffix(base, "-overlay"), true
+	default:
+		return
+	}
+	id = strings.ToLower(id)
+
+	media := bundled[id]
+	if media == nil {
+		media = &BundledMedia{}
+		bundled[id] = media
+	}
+	file := BundledFile{Archive: archive, Name: name}
+	if overlay {
+		media.Overlay = file
+	} else {
+		media.Main = file
+	}
+}
+
+// mediaID returns the media ID ("mid" parameter) of the item's download links.
+func mediaID(item MemoryItem) string {
+	for _, link := range []string{item.DownloadLink, item.URL} {
+		if mid := linkMediaID(link); mid != "" {
+			return mid
+		}
+	}
+	return ""
+}
+
+// linkMediaID returns the media ID of a single link, or "" when it has none.
+func linkMediaID(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return urlMediaID(u)
+}
+
+// urlMediaID returns the lower-cased "mid" parameter of a parsed link.
+func urlMediaID(u *url.URL) string {
+	return strings.ToLower(u.Query().Get("mid"))
+}
+
+// readZipFile reads a whole archive entry into memory.
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s in archive: %w", file.Name, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s from archive: %w", file.Name, err)
+	}
+	return data, nil
+}
+
+// openBundledFile opens the archive holding f and returns the entry.
+func openBundledFile(f BundledFile) (*zip.ReadCloser, *zip.File, error) {
+	reader, err := zip.OpenReader(f.Archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range reader.File {
+		if file.Name == f.Name {
+			return reader, file, nil
+		}
+	}
+	reader.Close()
+	return nil, nil, fmt.Errorf("%s not found in %s", f.Name, filepath.Base(f.Archive))
+}
+
+// extractBundled copies the item's bundled media to its .part file instead of
+// downloading it. Media with an overlay is repacked, without recompressing,
+// into a ZIP holding both files: the same shape as the download of a memory
+// with an overlay, so it goes through the regular overlay handling.
+func extractBundled(item MemoryItem, config Config) (string, error) {
+	if err := os.MkdirAll(tempDir(config), os.ModePerm); err != nil {
+		return "", err
+	}
+	partPath, _ := partPaths(config, item.ID)
+	if err := writeBundled(item.Bundled, partPath); err != nil {
+		removePart(partPath)
+		return "", err
+	}
+	return partPath, nil
+}
+
+// writeBundled writes the bundled media to partPath, see extractBundled.
+func writeBundled(media *BundledMedia, partPath string) error {
+	mainReader, main, err := openBundledFile(media.Main)
+	if err != nil {
+		return err
+	}
+	defer mainReader.Close()
+
+	if media.Overlay.Name == "" {
+		return extractZipFile(main, partPath)
+	}
+
+	overlayReader, overlay, err := openBundledFile(media.Overlay)
+	if err != nil {
+		return err
+	}
+	defer overlayReader.Close()
+
+	out, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	w := zip.NewWriter(out)
+	for _, file := range []*zip.File{main, overlay} {
+		if err := w.Copy(file); err != nil {
+			out.Close()
+			return fmt.Errorf("error copying %s from archive: %w", file.Name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
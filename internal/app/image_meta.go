@@ -0,0 +1,322 @@
+package app
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+	"sort"
+)
+
+// imageMetadata is the metadata of an image that describes it rather than its
+// pixels, kept when an overlay is merged onto the image.
+type imageMetadata struct {
+	exif []byte // TIFF structure, without the "Exif\0\0" prefix of JPEG
+	icc  []byte // ICC colour profile
+	xmp  []byte // XMP packet
+}
+
+const (
+	exifPrefix = "Exif\x00\x00"
+	xmpPrefix  = "http://ns.adobe.com/xap/1.0/\x00"
+	iccPrefix  = "ICC_PROFILE\x00"
+
+	// maxSegmentPayload is the most a JPEG segment can hold after its length.
+	maxSegmentPayload = 0xFFFF - 2
+)
+
+// readImageMetadata extracts the EXIF data, colour profile and XMP packet of
+// a JPEG, PNG or WebP image. Metadata that cannot be read is left out.
+func readImageMetadata(data []byte) imageMetadata {
+	switch DetectContainer(data) {
+	case ContainerJPEG:
+		return jpegMetadata(data)
+	case ContainerPNG:
+		return pngMetadata(data)
+	case ContainerWebP:
+		return webpMetadata(data)
+	}
+	return imageMetadata{}
+}
+
+// jpegMetadata reads the APP1 and APP2 segments of a JPEG image.
+func jpegMetadata(data []byte) imageMetadata {
+	var m imageMetadata
+	iccChunks := make(map[byte][]byte)
+	forEachJPEGSegment(data, func(marker byte, start, end int) {
+		payload := data[start+4 : end]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte(exifPrefix)) && m.exif == nil:
+			m.exif = payload[len(exifPrefix):]
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte(xmpPrefix)) && m.xmp == nil:
+			m.xmp = payload[len(xmpPrefix):]
+		case marker == 0xE2 && bytes.HasPrefix(payload, []byte(iccPrefix)) && len(payload) > len(iccPrefix)+2:
+			iccChunks[payload[len(iccPrefix)]] = payload[len(iccPrefix)+2:]
+		}
+	})
+
+	// Profiles too large for a segment are split across numbered chunks.
+	seqs := make([]int, 0, len(iccChunks))
+	for seq := range iccChunks {
+		seqs = append(seqs, int(seq))
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		m.icc = append(m.icc, iccChunks[byte(seq)]...)
+	}
+	return m
+}
+
+// forEachJPEGSegment calls fn with the marker and the extent, from the
+// marker to the end of the payload, of every segment of a JPEG image that
+// precedes the image data.
+func forEachJPEGSegment(data []byte, fn func(marker byte, start, end int)) {
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return
+		}
+		marker := data[pos+1]
+		if marker == 0xFF { // fill byte
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // image data or end of image
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return
+		}
+		fn(marker, pos, pos+2+length)
+		pos += 2 + length
+	}
+}
+
+// pngMetadata reads the eXIf, iCCP and XMP iTXt chunks of a PNG image.
+func pngMetadata(data []byte) imageMetadata {
+	var m imageMetadata
+	for pos := 8; pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) {
+			break
+		}
+		chunk := data[pos+8 : pos+8+length]
+		switch typ {
+		case "eXIf":
+			m.exif = bytes.TrimPrefix(chunk, []byte(exifPrefix))
+		case "iCCP":
+			// Profile name, NUL, compression method, then the zlib stream.
+			if i := bytes.IndexByte(chunk, 0); i >= 0 && i+2 <= len(chunk) {
+				m.icc = inflate(chunk[i+2:])
+			}
+		case "iTXt":
+			m.xmp = pngXMP(chunk, m.xmp)
+		case "IDAT", "IEND":
+			return m
+		}
+		pos += 12 + length
+	}
+	return m
+}
+
+// pngXMP returns the XMP packet of an iTXt chunk, or xmp when the chunk holds
+// other text.
+func pngXMP(chunk, xmp []byte) []byte {
+	const keyword = "XML:com.adobe.xmp\x00"
+	if !bytes.HasPrefix(chunk, []byte(keyword)) || len(chunk) < len(keyword)+2 {
+		return xmp
+	}
+	compressed := chunk[len(keyword)] == 1
+	// Language tag and translated keyword, each NUL-terminated.
+	rest := chunk[len(keyword)+2:]
+	for i := 0; i < 2; i++ {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return xmp
+		}
+		rest = rest[end+1:]
+	}
+	if compressed {
+		return inflate(rest)
+	}
+	return rest
+}
+
+// webpMetadata reads the EXIF, ICCP and XMP chunks of a WebP image.
+func webpMetadata(data []byte) imageMetadata {
+	var m imageMetadata
+	for pos := 12; pos+8 <= len(data); {
+		typ := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if length < 0 || pos+8+length > len(data) {
+			break
+		}
+		chunk := data[pos+8 : pos+8+length]
+		switch typ {
+		case "EXIF":
+			m.exif = bytes.TrimPrefix(chunk, []byte(exifPrefix))
+		case "ICCP":
+			m.icc = chunk
+		case "XMP ":
+			m.xmp = chunk
+		}
+		pos += 8 + length + length%2
+	}
+	return m
+}
+
+// inflate decompresses a zlib stream, or returns nil when it is corrupt.
+func inflate(data []byte) []byte {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// orientationTag is the EXIF tag telling how the stored image is rotated or
+// mirrored relative to how it is displayed.
+const orientationTag = 0x0112
+
+// orientationEntry returns the byte order of the EXIF data and the offset of
+// the value of its IFD0 orientation entry, or -1 when there is none.
+func (m imageMetadata) orientationEntry() (binary.ByteOrder, int) {
+	tiff := m.exif
+	if len(tiff) < 8 {
+		return nil, -1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, -1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return nil, -1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		// The orientation is a single SHORT, stored in the entry itself.
+		if order.Uint16(tiff[entry:]) == orientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			return order, entry + 8
+		}
+	}
+	return nil, -1
+}
+
+// orientation returns the EXIF orientation of the image, 1 when unset.
+func (m imageMetadata) orientation() int {
+	order, value := m.orientationEntry()
+	if value < 0 {
+		return 1
+	}
+	if o := int(order.Uint16(m.exif[value:])); o >= 1 && o <= 8 {
+		return o
+	}
+	return 1
+}
+
+// resetOrientation marks the image as stored upright, once orient has been
+// applied to its pixels.
+func (m *imageMetadata) resetOrientation() {
+	order, value := m.orientationEntry()
+	if value < 0 {
+		return
+	}
+	m.exif = bytes.Clone(m.exif)
+	order.PutUint16(m.exif[value:], 1)
+}
+
+// jpegSegments encodes the metadata as the APP1 and APP2 segments of a JPEG
+// image. EXIF data and XMP packets too large for a single segment are left
+// out; colour profiles are split into chunks.
+func (m imageMetadata) jpegSegments() []byte {
+	var out []byte
+	segment := func(marker byte, parts ...[]byte) {
+		length := 2
+		for _, p := range parts {
+			length += len(p)
+		}
+		out = append(out, 0xFF, marker)
+		out = binary.BigEndian.AppendUint16(out, uint16(length))
+		for _, p := range parts {
+			out = append(out, p...)
+		}
+	}
+
+	if len(m.exif) > 0 && len(exifPrefix)+len(m.exif) <= maxSegmentPayload {
+		segment(0xE1, []byte(exifPrefix), m.exif)
+	}
+	if len(m.xmp) > 0 && len(xmpPrefix)+len(m.xmp) <= maxSegmentPayload {
+		segment(0xE1, []byte(xmpPrefix), m.xmp)
+	}
+	if len(m.icc) > 0 {
+		const chunkSize = maxSegmentPayload - len(iccPrefix) - 2
+		count := (len(m.icc) + chunkSize - 1) / chunkSize
+		if count <= 255 {
+			for i := 0; i < count; i++ {
+				chunk := m.icc[i*chunkSize : min((i+1)*chunkSize, len(m.icc))]
+				segment(0xE2, []byte(iccPrefix), []byte{byte(i + 1), byte(count)}, chunk)
+			}
+		}
+	}
+	return out
+}
+
+// orient returns the image turned upright according to an EXIF orientation.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	// source maps a pixel of the upright image to the stored one.
+	source := func(x, y int) (int, int) {
+		switch orientation {
+		case 2: // mirrored
+			return w - 1 - x, y
+		case 3: // rotated 180°
+			return w - 1 - x, h - 1 - y
+		case 4: // mirrored vertically
+			return x, h - 1 - y
+		case 5: // mirrored along the diagonal
+			return y, x
+		case 6: // to be rotated 90° clockwise
+			return y, h - 1 - x
+		case 7: // mirrored along the anti-diagonal
+			return w - 1 - y, h - 1 - x
+		default: // 8, to be rotated 90° counter-clockwise
+			return w - 1 - y, x
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := source(x, y)
+			si := src.PixOffset(b.Min.X+sx, b.Min.Y+sy)
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// inputFormat is the kind of export detected by sniffInput.
+type inputFormat int
+
+const (
+	formatUnknown inputFormat = iota
+	formatHTML
+	formatJSON
+)
+
+// LoadInput reads a memories export and extracts its memory items. The format
+// (HTML, JSON or a Snapchat export ZIP) is detected from the content, not the
+// file name, and text exports are decoded from UTF-16 or a legacy charset when
+// a byte order mark or an HTML charset declaration says so.
+func LoadInput(path string) (ParseResult, error) {
+	zipped, err := isZipFile(path)
+	if err != nil {
+		return ParseResult{}, err
+	}
+	if zipped {
+		return ParseExportZip(path)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return ParseResult{}, err
+	}
+	content, err := decodeText(raw)
+	if err != nil {
+		return ParseResult{}, fmt.Errorf("error decoding %s: %w", path, err)
+	}
+
+	switch sniffInput(content) {
+	case formatJSON:
+		return ParseJSON(content)
+	case formatHTML:
+		return ParseHTML(string(content)), nil
+	default:
+		return ParseResult{}, fmt.Errorf("%s is not a Snapchat memories export (HTML, JSON or ZIP)", path)
+	}
+}
+
+// decodeText converts an export to UTF-8. A byte order mark takes precedence
+// and UTF-16 without one is recognised by the NUL bytes of its ASCII
+// characters. Valid UTF-8 is returned unchanged; anything else is decoded
+// according to its HTML charset declaration, or as Windows-1252.
+func decodeText(data []byte) ([]byte, error) {
+	var enc encoding.Encoding
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}),
+		bytes.HasPrefix(data, []byte{0xFF, 0xFE}),
+		bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		enc = unicode.UTF8
+	case len(data) >= 2 && data[0] == 0 && data[1] != 0:
+		enc = unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	case len(data) >= 2 && data[0] != 0 && data[1] == 0:
+		enc = unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case utf8.Valid(data):
+		return data, nil
+	default:
+		enc, _, _ = charset.DetermineEncoding(data, "text/html")
+	}
+
+	decoded, _, err := transform.Bytes(unicode.BOMOverride(enc.NewDecoder()), data)
+	return decoded, err
+}
+
+// sniffInput detects whether content holds a JSON or an HTML memories export.
+func sniffInput(content []byte) inputFormat {
+	trimmed := bytes.TrimSpace(content)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")) && bytes.Contains(trimmed, []byte(`"Saved Media"`)):
+		return formatJSON
+	case bytes.HasPrefix(trimmed, []byte("<")) && (bytes.Contains(trimmed, []byte("downloadMemories")) ||
+		bytes.Contains(bytes.ToLower(trimmed), []byte("<table"))):
+		return formatHTML
+	}
+	return formatUnknown
+}
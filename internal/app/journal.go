@@ -0,0 +1,245 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalFileName is the name of the download journal kept in the output directory.
+const JournalFileName = ".snap-memory-journal.jsonl"
+
+// ErrAlreadyDownloaded is reported for items the journal records as completed.
+var ErrAlreadyDownloaded = errors.New("already downloaded")
+
+// volatileParams lists URL query parameters that change every time a link is
+// signed, so they must not take part in an item's identity.
+var volatileParams = map[string]bool{
+	"sig":         true,
+	"signature":   true,
+	"ts":          true,
+	"timestamp":   true,
+	"expires":     true,
+	"exp":         true,
+	"token":       true,
+	"policy":      true,
+	"key-pair-id": true,
+}
+
+// NewItemID derives a stable identifier for a memory from its capture time and
+// the URL parameters that identify the media. Links carrying Snapchat's media
+// ID ("mid") are identified by it alone, so the download link of a JSON export
+// and the media URL of an HTML export give the same memory the same ID.
+// Otherwise signatures, timestamps and expiry parameters are ignored, so the
+// same memory keeps its ID when the export is requested again.
+func NewItemID(date time.Time, rawURL string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", date.Unix())
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		h.Write([]byte(rawURL))
+		return hex.EncodeToString(h.Sum(nil))[:16]
+	}
+	if mid := urlMediaID(u); mid != "" {
+		fmt.Fprintf(h, "mid=%s\n", mid)
+		return hex.EncodeToString(h.Sum(nil))[:16]
+	}
+
+	fmt.Fprintf(h, "%s%s\n", u.Host, u.Path)
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		lower := strings.ToLower(key)
+		if volatileParams[lower] || strings.HasPrefix(lower, "x-amz-") || strings.HasPrefix(lower, "x-goog-") {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%s\n", key, strings.Join(query[key], ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// itemID returns the item's ID, deriving it when the item was built without one.
+func itemID(item MemoryItem) string {
+	if item.ID != "" {
+		return item.ID
+	}
+	if item.DownloadLink != "" {
+		return NewItemID(item.Date, item.DownloadLink)
+	}
+	return NewItemID(item.Date, item.URL)
+}
+
+// JournalState is the recorded outcome of an item.
+type JournalState string
+
+const (
+	JournalDone    JournalState = "done"
+	JournalFailed  JournalState = "failed"
+	JournalSkipped JournalState = "skipped"
+	JournalExpired JournalState = "expired"
+)
+
+// JournalEntry is a single line of the journal.
+type JournalEntry struct {
+	ID    string       `json:"id"`
+	State JournalState `json:"state"`
+	Path  string       `json:"path,omitempty"`
+	Error string       `json:"error,omitempty"`
+	Time  time.Time    `json:"time"`
+}
+
+// Journal is an append-only JSON-lines log of per-item outcomes that lets an
+// interrupted run resume where it stopped. The last entry for an ID wins.
+type Journal struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]JournalEntry
+}
+
+// JournalPath returns the location of the journal for an output directory.
+func JournalPath(outputDir string) string {
+	return filepath.Join(outputDir, JournalFileName)
+}
+
+// OpenJournal loads the journal at path, creating it if needed, and opens it
+// for appending. Lines that cannot be decoded, such as one cut short by a
+// crash, are ignored, and a line cut short is ended so that new entries start
+// on a line of their own.
+func OpenJournal(path string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{file: f, entries: make(map[string]JournalEntry)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.ID == "" {
+			continue
+		}
+		j.entries[entry.ID] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	if err := endLastLine(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error repairing journal: %w", err)
+	}
+	return j, nil
+}
+
+// endLastLine appends a newline to the file when its last line is not ended.
+func endLastLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	if _, err := f.Write([]byte{'\n'}); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Lookup returns the latest entry recorded for id.
+func (j *Journal) Lookup(id string) (JournalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry, ok := j.entries[id]
+	return entry, ok
+}
+
+// Completed reports whether id was downloaded by a previous run and its output still exists.
+func (j *Journal) Completed(id string) (JournalEntry, bool) {
+	entry, ok := j.Lookup(id)
+	if !ok || entry.State != JournalDone {
+		return entry, false
+	}
+	if _, err := os.Stat(entry.Path); err != nil {
+		return entry, false
+	}
+	return entry, true
+}
+
+// Pending returns the items that are not recorded as completed.
+func (j *Journal) Pending(items []MemoryItem) []MemoryItem {
+	var pending []MemoryItem
+	for _, item := range items {
+		if _, ok := j.Completed(itemID(item)); !ok {
+			pending = append(pending, item)
+		}
+	}
+	return pending
+}
+
+// savedPaths returns the output paths of the items recorded as completed, by ID.
+func (j *Journal) savedPaths() map[string]string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	paths := make(map[string]string)
+	for id, entry := range j.entries {
+		if entry.State == JournalDone && entry.Path != "" {
+			paths[id] = entry.Path
+		}
+	}
+	return paths
+}
+
+// Len returns the number of items with a recorded outcome.
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.entries)
+}
+
+// Record appends entry to the journal and syncs it to disk.
+func (j *Journal) Record(entry JournalEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.entries[entry.ID] = entry
+	return j.file.Sync()
+}
+
+// Close closes the underlying file.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
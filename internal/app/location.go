@@ -0,0 +1,106 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// Location is where a memory was captured. The zero value is an unknown
+// location, which is what memories without usable coordinates get.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+	// Accuracy is the radius of uncertainty in meters; 0 when not reported.
+	Accuracy float64
+	// Valid is set when the coordinates are known and within range.
+	Valid bool
+}
+
+// coordinateRegex matches the numbers of a "Latitude, Longitude: 12.34, 56.78" location.
+var coordinateRegex = regexp.MustCompile(`[-+]?(?:\d+(?:\.\d*)?|\.\d+)`)
+
+// accuracyRegex matches an accuracy suffix such as "± 14.5 meters".
+var accuracyRegex = regexp.MustCompile(`±\s*(\d+(?:\.\d+)?)\s*(?:m|meters)?`)
+
+// NewLocation returns a known location, or an error when the coordinates are
+// outside ±90° latitude and ±180° longitude.
+func NewLocation(lat, lon float64) (Location, error) {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return Location{}, fmt.Errorf("latitude %g out of range", lat)
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return Location{}, fmt.Errorf("longitude %g out of range", lon)
+	}
+	return Location{Latitude: lat, Longitude: lon, Valid: true}, nil
+}
+
+// ParseLocation parses the location text of an export, such as
+// "Latitude, Longitude: 48.8584, 2.2945", optionally followed by an accuracy
+// like "± 14.5 meters". Text without coordinates and the "0.0, 0.0"
+// placeholder of memories captured without location yield an unknown
+// Location; malformed or out of range coordinates are an error.
+func ParseLocation(text string) (Location, error) {
+	var accuracy float64
+	if m := accuracyRegex.FindStringSubmatchIndex(text); m != nil {
+		accuracy, _ = strconv.ParseFloat(text[m[2]:m[3]], 64)
+		text = text[:m[0]] + text[m[1]:]
+	}
+
+	numbers := coordinateRegex.FindAllString(text, -1)
+	switch len(numbers) {
+	case 0:
+		return Location{}, nil
+	case 2:
+	default:
+		return Location{}, fmt.Errorf("malformed location %q", text)
+	}
+
+	lat, err := strconv.ParseFloat(numbers[0], 64)
+	if err != nil {
+		return Location{}, fmt.Errorf("malformed latitude %q", numbers[0])
+	}
+	lon, err := strconv.ParseFloat(numbers[1], 64)
+	if err != nil {
+		return Location{}, fmt.Errorf("malformed longitude %q", numbers[1])
+	}
+	if lat == 0 && lon == 0 {
+		return Location{}, nil
+	}
+
+	loc, err := NewLocation(lat, lon)
+	if err != nil {
+		return Location{}, err
+	}
+	loc.Accuracy = accuracy
+	return loc, nil
+}
+
+// parseItemLocation parses the location of an export row. A malformed or out
+// of range location leaves the memory without one rather than skipping it.
+func parseItemLocation(text string) Location {
+	loc, _ := ParseLocation(text)
+	return loc
+}
+
+// String formats the location as "lat, lon", or "unknown".
+func (l Location) String() string {
+	if !l.Valid {
+		return "unknown"
+	}
+	str := fmt.Sprintf("%.6f, %.6f", l.Latitude, l.Longitude)
+	if l.Accuracy > 0 {
+		str += fmt.Sprintf(" ±%gm", l.Accuracy)
+	}
+	return str
+}
+
+// key identifies the location for matching memories across exports, see
+// matchKey; the accuracy is left out.
+func (l Location) key() string {
+	if !l.Valid {
+		return ""
+	}
+	return fmt.Sprintf("%.6f,%.6f", l.Latitude, l.Longitude)
+}
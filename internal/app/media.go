@@ -0,0 +1,274 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"os"
+	"strings"
+)
+
+// MediaType is the kind of media a memory holds.
+type MediaType int
+
+const (
+	MediaUnknown MediaType = iota
+	MediaImage
+	MediaVideo
+)
+
+// ParseMediaType interprets the media type label of an export, such as
+// "Image", "PHOTO" or "Video".
+func ParseMediaType(label string) MediaType {
+	switch label = strings.ToLower(label); {
+	case strings.Contains(label, "video"):
+		return MediaVideo
+	case strings.Contains(label, "image"), strings.Contains(label, "photo"):
+		return MediaImage
+	}
+	return MediaUnknown
+}
+
+// String returns the media type's name.
+func (t MediaType) String() string {
+	switch t {
+	case MediaImage:
+		return "image"
+	case MediaVideo:
+		return "video"
+	default:
+		return "unknown"
+	}
+}
+
+// Extension returns the extension assumed for the media type until the
+// downloaded file tells its actual container.
+func (t MediaType) Extension() string {
+	if t == MediaVideo {
+		return ".mp4"
+	}
+	return ".jpg"
+}
+
+// Container is the file format of downloaded media.
+type Container int
+
+const (
+	ContainerUnknown Container = iota
+	ContainerJPEG
+	ContainerPNG
+	ContainerWebP
+	ContainerHEIC
+	ContainerMP4
+	ContainerMOV
+)
+
+// Extension returns the file extension for the container.
+func (c Container) Extension() string {
+	switch c {
+	case ContainerJPEG:
+		return ".jpg"
+	case ContainerPNG:
+		return ".png"
+	case ContainerWebP:
+		return ".webp"
+	case ContainerHEIC:
+		return ".heic"
+	case ContainerMP4:
+		return ".mp4"
+	case ContainerMOV:
+		return ".mov"
+	default:
+		return ""
+	}
+}
+
+// MediaType returns the kind of media the container holds.
+func (c Container) MediaType() MediaType {
+	switch c {
+	case ContainerJPEG, ContainerPNG, ContainerWebP, ContainerHEIC:
+		return MediaImage
+	case ContainerMP4, ContainerMOV:
+		return MediaVideo
+	default:
+		return MediaUnknown
+	}
+}
+
+// decodable reports whether overlays can be merged onto images in the container.
+func (c Container) decodable() bool {
+	switch c {
+	case ContainerJPEG, ContainerPNG, ContainerWebP:
+		return true
+	}
+	return false
+}
+
+// heifBrands lists the ISO base media file brands of HEIC/HEIF images.
+var heifBrands = map[string]bool{"heic": true, "heix": true, "hevc": true, "hevx": true, "heim": true, "heis": true, "mif1": true, "msf1": true}
+
+// DetectContainer identifies a media container from the first bytes of a file.
+func DetectContainer(header []byte) Container {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return ContainerJPEG
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return ContainerPNG
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return ContainerWebP
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		switch brand := string(header[8:12]); {
+		case heifBrands[brand]:
+			return ContainerHEIC
+		case brand == "qt  ":
+			return ContainerMOV
+		default:
+			return ContainerMP4
+		}
+	case len(header) >= 8 && (string(header[4:8]) == "moov" || string(header[4:8]) == "mdat" || string(header[4:8]) == "wide"):
+		// QuickTime files predating the ftyp box start with their atoms.
+		return ContainerMOV
+	}
+	return ContainerUnknown
+}
+
+// ContainerFromContentType maps a Content-Type header to a container.
+func ContainerFromContentType(contentType string) Container {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "image/jpeg", "image/jpg":
+		return ContainerJPEG
+	case "image/png":
+		return ContainerPNG
+	case "image/webp":
+		return ContainerWebP
+	case "image/heic", "image/heif":
+		return ContainerHEIC
+	case "video/mp4":
+		return ContainerMP4
+	case "video/quicktime":
+		return ContainerMOV
+	}
+	return ContainerUnknown
+}
+
+// sniffContainer detects the container of r from its first bytes.
+func sniffContainer(r io.Reader) (Container, error) {
+	header := make([]byte, 16)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ContainerUnknown, err
+	}
+	return DetectContainer(header[:n]), nil
+}
+
+// fileContainer detects the container of a downloaded .part file from its
+// magic bytes, falling back to the Content-Type recorded with the download.
+func fileContainer(partPath string) (Container, error) {
+	f, err := os.Open(partPath)
+	if err != nil {
+		return ContainerUnknown, err
+	}
+	defer f.Close()
+	c, err := sniffContainer(f)
+	if err != nil || c != ContainerUnknown {
+		return c, err
+	}
+
+	var meta partMeta
+	if data, err := os.ReadFile(partPath + ".json"); err == nil && json.Unmarshal(data, &meta) == nil {
+		return ContainerFromContentType(meta.ContentType), nil
+	}
+	return ContainerUnknown, nil
+}
+
+// zipEntryContainer detects the container of an archive entry.
+func zipEntryContainer(file *zip.File) (Container, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return ContainerUnknown, err
+	}
+	defer rc.Close()
+	return sniffContainer(rc)
+}
+
+// mediaEntries returns the main media and overlay entries of a memory's archive.
+func mediaEntries(files []*zip.File) (base, overlay *zip.File) {
+	for _, file := range files {
+		if strings.Contains(file.Name, "-overlay") {
+			overlay = file
+		} else if strings.Contains(file.Name, "-main") {
+			base = file
+		}
+	}
+	return base, overlay
+}
+
+// mergesOverlay reports whether the overlay of an item whose main media is in
+// the base container is merged onto it, rather than dropped.
+func mergesOverlay(item MemoryItem, base Container, config Config) bool {
+	switch item.Media {
+	case MediaImage:
+		return !config.SkipImageOverlay && (base == ContainerUnknown || base.decodable())
+	case MediaVideo:
+		return !config.SkipVideoOverlay
+	}
+	return false
+}
+
+// labelMedia returns the item's media type, falling back to its label and
+// extension for items built without one.
+func labelMedia(item MemoryItem) MediaType {
+	if item.Media != MediaUnknown {
+		return item.Media
+	}
+	if media := ParseMediaType(item.Type); media != MediaUnknown {
+		return media
+	}
+	if item.Extension == ".mp4" {
+		return MediaVideo
+	}
+	return MediaImage
+}
+
+// detectMedia sets the item's media type and extension from the downloaded
+// file rather than trusting the export's label, and reports whether an
+// overlay will be merged into it. Merged overlays are always written as JPEG
+// images and MP4 videos.
+func detectMedia(item *MemoryItem, path string, zipped bool, config Config) (bool, error) {
+	item.Media = labelMedia(*item)
+	if !zipped {
+		c, err := fileContainer(path)
+		if err != nil {
+			return false, err
+		}
+		if c != ContainerUnknown {
+			item.Media, item.Extension = c.MediaType(), c.Extension()
+		}
+		return false, nil
+	}
+
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	base, overlay := mediaEntries(reader.File)
+	if base == nil {
+		return false, nil
+	}
+	c, err := zipEntryContainer(base)
+	if err != nil {
+		return false, err
+	}
+	if c != ContainerUnknown {
+		item.Media, item.Extension = c.MediaType(), c.Extension()
+	}
+	if overlay != nil && mergesOverlay(*item, c, config) {
+		item.Extension = item.Media.Extension()
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// LoadInputs reads every export with LoadInput and merges them into one set,
+// see MergeResults. Warnings record the file they were found in.
+func LoadInputs(paths []string) (ParseResult, error) {
+	results := make([]ParseResult, 0, len(paths))
+	for _, path := range paths {
+		result, err := LoadInput(path)
+		if err != nil {
+			return ParseResult{}, err
+		}
+		for i := range result.Warnings {
+			result.Warnings[i].Source = path
+		}
+		results = append(results, result)
+	}
+	return MergeResults(results...), nil
+}
+
+// MergeResults combines the items of several exports, which overlap heavily
+// when they are requested months apart, so that every memory is downloaded
+// once. Items are keyed on their ID: the first occurrence keeps its position,
+// later copies are counted in Duplicates, and the links of every copy are
+// kept. Bundled media comes first, then the links signed last, so the newest
+// export is tried first whatever the order of the inputs, and the others
+// remain as Fallbacks.
+func MergeResults(results ...ParseResult) ParseResult {
+	var merged ParseResult
+	seen := make(map[string]int)
+	for _, result := range results {
+		merged.Warnings = append(merged.Warnings, result.Warnings...)
+		merged.Duplicates += result.Duplicates
+		for _, item := range result.Items {
+			item.ID = itemID(item)
+			idx, ok := seen[item.ID]
+			if !ok {
+				seen[item.ID] = len(merged.Items)
+				merged.Items = append(merged.Items, item)
+				continue
+			}
+
+			merged.Duplicates++
+			first := &merged.Items[idx]
+			first.Fallbacks = append(append(first.Fallbacks, item.links()), item.Fallbacks...)
+		}
+	}
+	for i, item := range merged.Items {
+		if len(item.Fallbacks) > 0 {
+			merged.Items[i] = item.preferLinks()
+		}
+	}
+	return merged
+}
+
+// links returns the item's own links.
+func (m MemoryItem) links() ItemLinks {
+	return ItemLinks{URL: m.URL, DownloadLink: m.DownloadLink, Bundled: m.Bundled}
+}
+
+// withLinks returns the item with links in place of its own.
+func (m MemoryItem) withLinks(links ItemLinks) MemoryItem {
+	m.URL, m.DownloadLink, m.Bundled = links.URL, links.DownloadLink, links.Bundled
+	return m
+}
+
+// preferLinks returns the item with the best of its links and fallbacks as
+// its own: bundled media, then the links signed last. Links of later exports
+// win ties, and links that are repeated or empty are dropped.
+func (m MemoryItem) preferLinks() MemoryItem {
+	all := append([]ItemLinks{m.links()}, m.Fallbacks...)
+	slices.Reverse(all)
+	slices.SortStableFunc(all, func(a, b ItemLinks) int {
+		if (a.Bundled != nil) != (b.Bundled != nil) {
+			if a.Bundled != nil {
+				return -1
+			}
+			return 1
+		}
+		return b.signed().Compare(a.signed())
+	})
+
+	var kept []ItemLinks
+	for _, links := range all {
+		if (links != ItemLinks{}) && !slices.Contains(kept, links) {
+			kept = append(kept, links)
+		}
+	}
+	if len(kept) == 0 {
+		return m
+	}
+	m = m.withLinks(kept[0])
+	m.Fallbacks = kept[1:]
+	return m
+}
+
+// signed returns when the links were signed, judging from the timestamp of
+// Snapchat's links ("ts", in seconds or milliseconds), AWS signatures
+// (X-Amz-Date) or the expiry of other signed URLs. It is zero when unknown.
+func (l ItemLinks) signed() time.Time {
+	var latest time.Time
+	for _, raw := range []string{l.URL, l.DownloadLink} {
+		u, err := url.Parse(raw)
+		if err != nil || raw == "" {
+			continue
+		}
+		query := u.Query()
+		var t time.Time
+		if unix, err := strconv.ParseInt(query.Get("ts"), 10, 64); err == nil && unix > 1e12 {
+			t = time.UnixMilli(unix)
+		} else if err == nil && unix > 1e9 {
+			t = time.Unix(unix, 0)
+		} else if date, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date")); err == nil {
+			t = date
+		} else {
+			for _, key := range []string{"Expires", "expires"} {
+				if unix, err := strconv.ParseInt(query.Get(key), 10, 64); err == nil && unix > 1e9 {
+					t = time.Unix(unix, 0)
+					break
+				}
+			}
+		}
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
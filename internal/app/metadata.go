@@ -9,8 +9,11 @@ import (
 	"github.com/dsoprea/go-jpeg-image-structure/v2"
 )
 
-// updateNativeExif updates the EXIF data of a JPEG file.
-func updateNativeExif(path string, lat, lon float64, dateTime time.Time) error {
+// updateNativeExif updates the EXIF data of a JPEG file. Dates are written in
+// the time zone of dateTime, which the offset tags record; GPS tags are only
+// written for a known location. The file is rewritten atomically, see
+// writeFileAtomic, so it is never left truncated.
+func updateNativeExif(path string, loc Location, dateTime time.Time) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return err
@@ -28,16 +31,30 @@ func updateNativeExif(path string, lat, lon float64, dateTime time.Time) error {
 		return err
 	}
 
-	ifdIb, _ := exif.GetOrCreateIbFromRootIb(rootIb, "IFD0")
-	exifIb, _ := exif.GetOrCreateIbFromRootIb(rootIb, "IFD0/Exif")
-	gpsIb, _ := exif.GetOrCreateIbFromRootIb(rootIb, "IFD0/GPSInfo")
+	ifdIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD0")
+	if err != nil {
+		return err
+	}
+	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD0/Exif")
+	if err != nil {
+		return err
+	}
+	gpsIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD0/GPSInfo")
+	if err != nil {
+		return err
+	}
 
 	dtStr := dateTime.Format("2006:01:02 15:04:05")
 	_ = ifdIb.SetStandardWithName("DateTime", dtStr)
 	_ = exifIb.SetStandardWithName("DateTimeOriginal", dtStr)
 	_ = exifIb.SetStandardWithName("CreateDate", dtStr)
+	offset := dateTime.Format("-07:00")
+	_ = exifIb.SetStandardWithName("OffsetTime", offset)
+	_ = exifIb.SetStandardWithName("OffsetTimeOriginal", offset)
+	_ = exifIb.SetStandardWithName("OffsetTimeDigitized", offset)
 
-	if lat != 0 || lon != 0 {
+	if loc.Valid {
+		lat, lon := loc.Latitude, loc.Longitude
 		latRef, lonRef := "N", "E"
 		if lat < 0 {
 			latRef, lat = "S", -lat
@@ -52,10 +69,12 @@ func updateNativeExif(path string, lat, lon float64, dateTime time.Time) error {
 		_ = gpsIb.SetStandardWithName("GPSLongitude", decimalToRationals(lon))
 	}
 
-	_ = sl.SetExif(rootIb)
-	f, _ := os.Create(path)
-	defer f.Close()
-	_ = sl.Write(f)
+	if err := sl.SetExif(rootIb); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, sl.Write); err != nil {
+		return err
+	}
 	return os.Chtimes(path, dateTime, dateTime)
 }
 
@@ -0,0 +1,330 @@
+package app
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// mp4Epoch is the origin of the timestamps of MP4 and QuickTime files.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// mp4Containers are the boxes leading to the ones updateVideoMetadata edits.
+// Other boxes are kept as opaque bytes.
+var mp4Containers = map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "udta": true}
+
+// xyzAtom is the QuickTime user data atom holding an ISO 6709 location,
+// which Apple and Android devices write and photo libraries read.
+const xyzAtom = "\xa9xyz"
+
+// mp4Box is a box (atom) of an MP4 or QuickTime movie header.
+type mp4Box struct {
+	typ      string
+	data     []byte    // payload of a leaf box
+	children []*mp4Box // boxes of a container
+	trailer  []byte    // bytes after the last child, such as a QuickTime terminator
+}
+
+// mp4Extent locates a top-level box within the file.
+type mp4Extent struct {
+	typ          string
+	offset, size int64
+	header       int64 // length of the size and type fields
+}
+
+// updateVideoMetadata sets the creation and modification times of an MP4 or
+// QuickTime video, in its movie, track and media headers, and records a known
+// location in a ©xyz atom. The movie header is rewritten without touching the
+// media data; when it grows and precedes the media, the chunk offsets are
+// shifted to match. Files that are not MP4 or QuickTime movies, and
+// fragmented ones, are left as they are.
+func updateVideoMetadata(path string, loc Location, dateTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if c, err := sniffContainer(f); err != nil {
+		return err
+	} else if c != ContainerMP4 && c != ContainerMOV {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	extents, err := readMP4Extents(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("error reading video: %w", err)
+	}
+	var moov *mp4Extent
+	for i, e := range extents {
+		switch e.typ {
+		case "moov":
+			if moov == nil {
+				moov = &extents[i]
+			}
+		case "moof":
+			return nil
+		}
+	}
+	if moov == nil {
+		return errors.New("error reading video: no movie header")
+	}
+
+	payload := make([]byte, moov.size-moov.header)
+	if _, err := f.ReadAt(payload, moov.offset+moov.header); err != nil {
+		return fmt.Errorf("error reading video: %w", err)
+	}
+	children, trailer, err := parseMP4Boxes(payload)
+	if err != nil {
+		return fmt.Errorf("error reading video: %w", err)
+	}
+	root := &mp4Box{typ: "moov", children: children, trailer: trailer}
+
+	setMovieTimes(root, dateTime)
+	if loc.Valid {
+		setMovieLocation(root, loc)
+	}
+
+	// Media data after the movie header moves by as much as the header grows.
+	if delta := int64(len(root.encode())) - moov.size; delta != 0 {
+		if err := shiftChunkOffsets(root, moov.offset, delta); err != nil {
+			return err
+		}
+	}
+	header := root.encode()
+
+	err = writeFileAtomic(path, func(w io.Writer) error {
+		if _, err := io.Copy(w, io.NewSectionReader(f, 0, moov.offset)); err != nil {
+			return err
+		}
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		end := moov.offset + moov.size
+		if _, err := io.Copy(w, io.NewSectionReader(f, end, info.Size()-end)); err != nil {
+			return err
+		}
+		// Closed before the rename, which Windows refuses for open files.
+		return f.Close()
+	})
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, dateTime, dateTime)
+}
+
+// readMP4Extents lists the top-level boxes of a file of the given size.
+func readMP4Extents(r io.ReaderAt, size int64) ([]mp4Extent, error) {
+	var extents []mp4Extent
+	for offset := int64(0); offset < size; {
+		if size-offset < 8 {
+			return nil, fmt.Errorf("truncated box at offset %d", offset)
+		}
+		var buf [16]byte
+		if _, err := r.ReadAt(buf[:8], offset); err != nil {
+			return nil, err
+		}
+		e := mp4Extent{typ: string(buf[4:8]), offset: offset, size: int64(binary.BigEndian.Uint32(buf[:4])), header: 8}
+		switch e.size {
+		case 0: // the box extends to the end of the file
+			e.size = size - offset
+		case 1: // the size follows the type as a 64-bit number
+			if _, err := r.ReadAt(buf[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			e.size, e.header = int64(binary.BigEndian.Uint64(buf[8:16])), 16
+		}
+		if e.size < e.header || e.size > size-offset {
+			return nil, fmt.Errorf("invalid size of %q box at offset %d", e.typ, offset)
+		}
+		extents = append(extents, e)
+		offset += e.size
+	}
+	return extents, nil
+}
+
+// parseMP4Boxes parses a sequence of boxes, descending into mp4Containers.
+// Fewer bytes than a box header at the end are returned as a trailer.
+func parseMP4Boxes(data []byte) ([]*mp4Box, []byte, error) {
+	var boxes []*mp4Box
+	for len(data) >= 8 {
+		size, header := uint64(binary.BigEndian.Uint32(data[:4])), uint64(8)
+		typ := string(data[4:8])
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, nil, fmt.Errorf("truncated %q box", typ)
+			}
+			size, header = binary.BigEndian.Uint64(data[8:16]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("invalid size of %q box", typ)
+		}
+
+		box := &mp4Box{typ: typ, data: data[header:size]}
+		if mp4Containers[typ] {
+			children, trailer, err := parseMP4Boxes(box.data)
+			switch {
+			case err == nil:
+				box.data, box.children, box.trailer = nil, children, trailer
+			case typ != "udta":
+				return nil, nil, err
+			}
+			// User data that is not a list of atoms is kept as it is.
+		}
+		boxes = append(boxes, box)
+		data = data[size:]
+	}
+	return boxes, data, nil
+}
+
+// isContainer reports whether the box was parsed into children.
+func (b *mp4Box) isContainer() bool {
+	return b.data == nil
+}
+
+// encode serialises the box with its header.
+func (b *mp4Box) encode() []byte {
+	payload := b.data
+	if b.isContainer() {
+		payload = nil
+		for _, child := range b.children {
+			payload = append(payload, child.encode()...)
+		}
+		payload = append(payload, b.trailer...)
+	}
+
+	size := uint64(len(payload)) + 8
+	if size > math.MaxUint32 {
+		out := make([]byte, 16, size+8)
+		binary.BigEndian.PutUint32(out, 1)
+		copy(out[4:8], b.typ)
+		binary.BigEndian.PutUint64(out[8:], size+8)
+		return append(out, payload...)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:8], b.typ)
+	return append(out, payload...)
+}
+
+// child returns the first child box of the given type, or nil.
+func (b *mp4Box) child(typ string) *mp4Box {
+	for _, c := range b.children {
+		if c.typ == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// walk calls fn for the box and all boxes below it.
+func (b *mp4Box) walk(fn func(*mp4Box)) {
+	fn(b)
+	for _, c := range b.children {
+		c.walk(fn)
+	}
+}
+
+// setMovieTimes sets the creation and modification times of the movie
+// header and of the header and media header of every track.
+func setMovieTimes(moov *mp4Box, t time.Time) {
+	secs := uint64(t.Unix() - mp4Epoch.Unix())
+	setBoxTimes(moov.child("mvhd"), secs)
+	for _, trak := range moov.children {
+		if trak.typ != "trak" {
+			continue
+		}
+		setBoxTimes(trak.child("tkhd"), secs)
+		if mdia := trak.child("mdia"); mdia != nil {
+			setBoxTimes(mdia.child("mdhd"), secs)
+		}
+	}
+}
+
+// setBoxTimes sets the creation and modification times of an mvhd, tkhd or
+// mdhd box, which all start with them after their version and flags.
+func setBoxTimes(b *mp4Box, secs uint64) {
+	if b == nil || b.isContainer() || len(b.data) < 4 {
+		return
+	}
+	switch version := b.data[0]; {
+	case version == 0 && len(b.data) >= 12 && secs <= math.MaxUint32:
+		binary.BigEndian.PutUint32(b.data[4:], uint32(secs))
+		binary.BigEndian.PutUint32(b.data[8:], uint32(secs))
+	case version == 1 && len(b.data) >= 20:
+		binary.BigEndian.PutUint64(b.data[4:], secs)
+		binary.BigEndian.PutUint64(b.data[12:], secs)
+	}
+}
+
+// setMovieLocation records the location in the movie's ©xyz user data atom,
+// replacing any location already there.
+func setMovieLocation(moov *mp4Box, loc Location) {
+	udta := moov.child("udta")
+	if udta == nil || !udta.isContainer() {
+		udta = &mp4Box{typ: "udta"}
+		moov.children = append(moov.children, udta)
+	}
+
+	value := fmt.Sprintf("%+08.4f%+09.4f/", loc.Latitude, loc.Longitude)
+	data := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint16(data, uint16(len(value)))
+	binary.BigEndian.PutUint16(data[2:], 0x15c7) // packed language code "und", as written by cameras
+	data = append(data, value...)
+
+	for _, c := range udta.children {
+		if c.typ == xyzAtom {
+			c.data = data
+			return
+		}
+	}
+	udta.children = append(udta.children, &mp4Box{typ: xyzAtom, data: data})
+}
+
+// shiftChunkOffsets moves the chunk offsets of every track that point past
+// the movie header at moovOffset by delta bytes.
+func shiftChunkOffsets(moov *mp4Box, moovOffset, delta int64) error {
+	var err error
+	moov.walk(func(b *mp4Box) {
+		if err != nil || b.isContainer() || (b.typ != "stco" && b.typ != "co64") || len(b.data) < 8 {
+			return
+		}
+		width := 4
+		if b.typ == "co64" {
+			width = 8
+		}
+		count := int(binary.BigEndian.Uint32(b.data[4:8]))
+		if count > (len(b.data)-8)/width {
+			err = fmt.Errorf("error reading video: truncated %s box", b.typ)
+			return
+		}
+		for i := 0; i < count; i++ {
+			entry := b.data[8+i*width:]
+			if width == 4 {
+				offset := int64(binary.BigEndian.Uint32(entry))
+				if offset <= moovOffset {
+					continue
+				}
+				if offset+delta < 0 || offset+delta > math.MaxUint32 {
+					err = errors.New("error updating video: chunk offsets exceed 32 bits")
+					return
+				}
+				binary.BigEndian.PutUint32(entry, uint32(offset+delta))
+			} else if offset := int64(binary.BigEndian.Uint64(entry)); offset > moovOffset {
+				binary.BigEndian.PutUint64(entry, uint64(offset+delta))
+			}
+		}
+	})
+	return err
+}
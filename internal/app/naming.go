@@ -0,0 +1,423 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultNameTemplate is the layout of the output directory when no template
+// is configured: one folder per month, and files named after the memory's
+// type and capture time.
+const DefaultNameTemplate = "{year}/{month}/{type} {date}{ext}"
+
+// defaultDateLayout is the time layout of {date} without a format or Config.DateFormat.
+const defaultDateLayout = "02-Jan-2006 15-04-05"
+
+// nameFields lists the fields of a name template and whether they take a
+// format after a colon, as in {date:YYYYMMDD}.
+var nameFields = map[string]bool{
+	"year": false, "month": false, "day": false,
+	"hour": false, "minute": false, "second": false,
+	"date": true, "type": false, "media": false,
+	"lat": true, "lon": true, "overlay": true,
+	"index": true, "seq": true, "id": true, "ext": false,
+}
+
+// NameTemplate lays out the path of a memory within the output directory,
+// e.g. "{year}/{month}/{type}_{date:YYYYMMDD_HHmmss}_{seq}{ext}". Fields
+// are replaced by the memory's values and "/" separates directories:
+//
+//	{year} {month} {day} {hour} {minute} {second}  local capture time
+//	{date}, {date:YYYYMMDD_HHmmss}  capture time, see FormatDateCustom
+//	{type}  type label of the export, {media}  "image" or "video"
+//	{lat}, {lon}, {lat:N}  coordinates with N decimals (6), empty when unknown
+//	{overlay}, {overlay:TEXT}  "overlay" or TEXT when an overlay is merged, else empty
+//	{index}, {seq}, {index:N}  position in the input from 1, zero-padded to N digits
+//	{id}, {id:N}  memory ID, or its first N characters
+//	{ext}  file extension, appended when the template leaves it out
+//
+// The zero value is DefaultNameTemplate.
+type NameTemplate struct {
+	text     string
+	segments [][]namePart
+}
+
+// namePart is literal text or a field of a template segment.
+type namePart struct {
+	literal string
+	field   string
+	format  string
+}
+
+// invalidNameChars are the characters that cannot be used in file names on
+// every supported platform.
+const invalidNameChars = `\:*?"<>|`
+
+var defaultNameTemplate = mustParseNameTemplate(DefaultNameTemplate)
+
+func mustParseNameTemplate(text string) NameTemplate {
+	t, err := ParseNameTemplate(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// ParseNameTemplate parses and validates a name template, see NameTemplate.
+// An empty template is DefaultNameTemplate.
+func ParseNameTemplate(text string) (NameTemplate, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return NameTemplate{}, nil
+	}
+	if strings.HasPrefix(text, "/") {
+		return NameTemplate{}, fmt.Errorf("name template %q must be relative to the output directory", text)
+	}
+
+	t := NameTemplate{text: text}
+	var segment []namePart
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			segment = append(segment, namePart{literal: literal.String()})
+			literal.Reset()
+		}
+	}
+	endSegment := func() error {
+		flush()
+		if len(segment) == 0 {
+			return fmt.Errorf("name template %q has an empty path element", text)
+		}
+		if len(segment) == 1 && (segment[0].literal == "." || segment[0].literal == "..") {
+			return fmt.Errorf("name template %q must not contain %q", text, segment[0].literal)
+		}
+		t.segments = append(t.segments, segment)
+		segment = nil
+		return nil
+	}
+
+	var hasExt bool
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '/':
+			if err := endSegment(); err != nil {
+				return NameTemplate{}, err
+			}
+		case c == '{':
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				return NameTemplate{}, fmt.Errorf("name template %q has an unclosed {", text)
+			}
+			part, err := parseNameField(text[i+1 : i+end])
+			if err != nil {
+				return NameTemplate{}, err
+			}
+			hasExt = hasExt || part.field == "ext"
+			flush()
+			segment = append(segment, part)
+			i += end
+		case c == '}':
+			return NameTemplate{}, fmt.Errorf("name template %q has an unmatched }", text)
+		case strings.IndexByte(invalidNameChars, c) >= 0 || c < ' ':
+			return NameTemplate{}, fmt.Errorf("name template %q contains %q, which is not allowed in file names", text, c)
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	if !hasExt {
+		segment = append(segment, namePart{field: "ext"})
+	}
+	if err := endSegment(); err != nil {
+		return NameTemplate{}, err
+	}
+	return t, nil
+}
+
+// parseNameField parses the "name" or "name:format" between the braces of a field.
+func parseNameField(spec string) (namePart, error) {
+	name, format, hasFormat := strings.Cut(spec, ":")
+	takesFormat, ok := nameFields[name]
+	switch {
+	case !ok:
+		return namePart{}, fmt.Errorf("unknown field {%s} in name template", spec)
+	case hasFormat && !takesFormat:
+		return namePart{}, fmt.Errorf("field {%s} does not take a format", name)
+	case hasFormat && format == "":
+		return namePart{}, fmt.Errorf("field {%s} has an empty format", spec)
+	}
+	switch name {
+	case "lat", "lon", "index", "seq", "id":
+		if n, err := strconv.Atoi(format); hasFormat && (err != nil || n < 0 || n > 32) {
+			return namePart{}, fmt.Errorf("field {%s} takes a number from 0 to 32", spec)
+		}
+	}
+	return namePart{field: name, format: format}, nil
+}
+
+// String returns the text of the template.
+func (t NameTemplate) String() string {
+	if t.segments == nil {
+		return DefaultNameTemplate
+	}
+	return t.text
+}
+
+// nameValues are the values of a memory that are not part of its MemoryItem.
+type nameValues struct {
+	local      time.Time // capture time in the configured time zone
+	overlay    bool      // an overlay is merged into the file
+	index      int       // position in the input, from 0
+	suffix     string    // inserted before the extension, see nameClaims
+	dateFormat string    // format of {date}, see Config.DateFormat
+}
+
+// path returns the slash-separated path of the memory.
+func (t NameTemplate) path(item MemoryItem, v nameValues) string {
+	segments := t.segments
+	if segments == nil {
+		segments = defaultNameTemplate.segments
+	}
+	elems := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		var b strings.Builder
+		for _, part := range segment {
+			if part.field == "" {
+				b.WriteString(part.literal)
+			} else {
+				b.WriteString(sanitizeName(part.value(item, v)))
+			}
+		}
+		elem := strings.TrimSpace(b.String())
+		if elem == "" || elem == "." || elem == ".." {
+			// Fields left empty, e.g. {lat} of a memory without location.
+			continue
+		}
+		elems = append(elems, elem)
+	}
+	return path.Join(elems...)
+}
+
+// value returns the field's value for the memory.
+func (p namePart) value(item MemoryItem, v nameValues) string {
+	switch p.field {
+	case "year":
+		return v.local.Format("2006")
+	case "month":
+		return v.local.Format("01")
+	case "day":
+		return v.local.Format("02")
+	case "hour":
+		return v.local.Format("15")
+	case "minute":
+		return v.local.Format("04")
+	case "second":
+		return v.local.Format("05")
+	case "date":
+		switch {
+		case p.format != "":
+			return FormatDateCustom(v.local, p.format)
+		case v.dateFormat != "":
+			return FormatDateCustom(v.local, v.dateFormat)
+		}
+		return v.local.Format(defaultDateLayout)
+	case "type":
+		return item.Type
+	case "media":
+		return item.Media.String()
+	case "lat", "lon":
+		if !item.Location.Valid {
+			return ""
+		}
+		decimals := 6
+		if p.format != "" {
+			decimals, _ = strconv.Atoi(p.format)
+		}
+		coord := item.Location.Latitude
+		if p.field == "lon" {
+			coord = item.Location.Longitude
+		}
+		return strconv.FormatFloat(coord, 'f', decimals, 64)
+	case "overlay":
+		if !v.overlay {
+			return ""
+		}
+		if p.format != "" {
+			return p.format
+		}
+		return "overlay"
+	case "index", "seq":
+		width, _ := strconv.Atoi(p.format)
+		return fmt.Sprintf("%0*d", width, v.index+1)
+	case "id":
+		id := itemID(item)
+		if n, err := strconv.Atoi(p.format); err == nil && n > 0 && n < len(id) {
+			id = id[:n]
+		}
+		return id
+	case "ext":
+		return v.suffix + item.Extension
+	}
+	return ""
+}
+
+// namePaths returns the slash-separated paths, relative to the output
+// directory and without extension, that a memory may be saved under, for
+// detecting collisions before its media is downloaded. The download decides
+// the extension, whether the memory is a ZIP archive saved in an overlay
+// folder and whether an overlay is merged, so every such path is returned.
+func namePaths(item MemoryItem, index int, config Config) []string {
+	item.Extension = ""
+	v := nameValues{local: config.TimeZone.LocalTime(item), index: index, dateFormat: config.DateFormat}
+	names := []string{config.NameTemplate.path(item, v)}
+	v.overlay = true
+	if merged := config.NameTemplate.path(item, v); merged != names[0] {
+		names = append(names, merged)
+	}
+
+	paths := append([]string(nil), names...)
+	for _, folder := range []string{overlayFolder(MediaImage), overlayFolder(MediaVideo)} {
+		for _, name := range names {
+			paths = append(paths, path.Join(folder, name))
+		}
+	}
+	return paths
+}
+
+// nameKey identifies a path without extension, ignoring case for the sake of
+// case-insensitive file systems.
+func nameKey(p string) string {
+	return strings.ToLower(p)
+}
+
+// nameClaims decides which memories keep the name the template gives them.
+// A name is taken once a memory of the run claimed it, when the journal
+// records it as the output of another memory, or when a file the journal
+// does not account for already has it. Memories are named in input order, in
+// batch and streamed runs alike: the first to claim a free name keeps it and
+// the others get idSuffix, so an earlier run's files are never overwritten
+// and every memory keeps its name when the input grows.
+type nameClaims struct {
+	config  Config
+	claimed map[string]string          // name key → ID of the memory that claimed it
+	owners  map[string]string          // name key → ID the journal records as saved there
+	files   map[string]map[string]bool // directory → name keys of the files in it
+}
+
+// newNameClaims prepares the claims of a run writing to config.OutputDir.
+// journal may be nil.
+func newNameClaims(config Config, journal *Journal) *nameClaims {
+	c := &nameClaims{
+		config:  config,
+		claimed: make(map[string]string),
+		owners:  make(map[string]string),
+		files:   make(map[string]map[string]bool),
+	}
+	if journal == nil {
+		return c
+	}
+	outDir, err := filepath.Abs(config.OutputDir)
+	if err != nil {
+		return c
+	}
+	for id, p := range journal.savedPaths() {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(outDir, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		c.owners[nameKey(strings.TrimSuffix(rel, path.Ext(rel)))] = id
+	}
+	return c
+}
+
+// suffix claims the name of the memory at index of the input and returns the
+// suffix that sets it apart when the name is taken.
+func (c *nameClaims) suffix(item MemoryItem, index int) string {
+	id := itemID(item)
+	paths := namePaths(item, index, c.config)
+	for _, p := range paths {
+		key := nameKey(p)
+		if owner, ok := c.claimed[key]; ok && owner != id {
+			return idSuffix(item)
+		}
+		if owner, ok := c.owners[key]; ok {
+			if owner != id {
+				return idSuffix(item)
+			}
+		} else if c.onDisk(p) {
+			return idSuffix(item)
+		}
+	}
+	for _, p := range paths {
+		c.claimed[nameKey(p)] = id
+	}
+	return ""
+}
+
+// onDisk reports whether a file in the output directory has the path p,
+// whatever its extension. XMP sidecars do not count: they are rewritten with
+// the memory they describe. Directories are read once per run.
+func (c *nameClaims) onDisk(p string) bool {
+	dir := path.Dir(p)
+	files, ok := c.files[dir]
+	if !ok {
+		files = make(map[string]bool)
+		entries, _ := os.ReadDir(filepath.Join(c.config.OutputDir, filepath.FromSlash(dir)))
+		for _, e := range entries {
+			name := e.Name()
+			if ext := filepath.Ext(name); !e.IsDir() && !strings.EqualFold(ext, ".xmp") {
+				files[nameKey(path.Join(dir, strings.TrimSuffix(name, ext)))] = true
+			}
+		}
+		c.files[dir] = files
+	}
+	return files[nameKey(p)]
+}
+
+// idSuffix is the suffix of a memory whose name is taken. It is derived from
+// the memory's ID rather than numbered, so it does not depend on the other
+// memories of the input or on earlier runs.
+func idSuffix(item MemoryItem) string {
+	id := itemID(item)
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return "_" + id
+}
+
+// sanitizeName replaces the characters of a field value that cannot be part
+// of a file name.
+func sanitizeName(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r < ' ' || strings.ContainsRune(invalidNameChars, r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// PreviewName returns the path, relative to the output directory, that the
+// configured name template gives an example memory: a photo with an overlay
+// taken in Los Angeles.
+func PreviewName(config Config) string {
+	loc, _ := NewLocation(34.052235, -118.243683)
+	item := MemoryItem{
+		Date:      time.Date(2023, 10, 28, 6, 30, 15, 0, time.UTC),
+		Type:      "Image",
+		Media:     MediaImage,
+		Extension: ".jpg",
+		Location:  loc,
+		ID:        "3f2a9c41d07be865",
+	}
+	v := nameValues{local: config.TimeZone.LocalTime(item), overlay: true, dateFormat: config.DateFormat}
+	return filepath.FromSlash(config.NameTemplate.path(item, v))
+}
@@ -2,29 +2,59 @@ package app
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"image/draw"
 	"image/jpeg"
-	"os"
+	_ "image/png"
+	"io"
 
 	xdraw "golang.org/x/image/draw"
 	_ "golang.org/x/image/webp"
 )
 
-// mergeImages merges a background image with an overlay.
-func mergeImages(bgData, ovData []byte, outPath string) {
-	bgImg, _, _ := image.Decode(bytes.NewReader(bgData))
-	ovImg, _, _ := image.Decode(bytes.NewReader(ovData))
-	if bgImg == nil || ovImg == nil {
-		return
+// mergeImages merges a background image with an overlay and writes the result
+// to outPath as a JPEG image, see writeFileAtomic. The background is turned
+// upright according to its EXIF orientation, as the overlay is drawn for the
+// upright image, and its EXIF data, colour profile and XMP packet are carried
+// over to the result.
+func mergeImages(bg, ov io.Reader, outPath string) error {
+	bgData, err := io.ReadAll(bg)
+	if err != nil {
+		return fmt.Errorf("error reading image: %w", err)
 	}
-	bounds := bgImg.Bounds()
-	final := image.NewRGBA(bounds)
-	draw.Draw(final, bounds, bgImg, image.Point{}, draw.Src)
+	bgImg, _, err := image.Decode(bytes.NewReader(bgData))
+	if err != nil {
+		return fmt.Errorf("error decoding image: %w", err)
+	}
+	ovImg, _, err := image.Decode(ov)
+	if err != nil {
+		return fmt.Errorf("error decoding overlay: %w", err)
+	}
+	meta := readImageMetadata(bgData)
+
+	stored := image.NewRGBA(bgImg.Bounds())
+	draw.Draw(stored, stored.Bounds(), bgImg, bgImg.Bounds().Min, draw.Src)
+	final := orient(stored, meta.orientation())
+	meta.resetOrientation()
+
+	bounds := final.Bounds()
 	resizedOv := image.NewRGBA(bounds)
 	xdraw.BiLinear.Scale(resizedOv, bounds, ovImg, ovImg.Bounds(), xdraw.Over, nil)
 	draw.Draw(final, bounds, resizedOv, image.Point{}, draw.Over)
-	f, _ := os.Create(outPath)
-	defer f.Close()
-	jpeg.Encode(f, final, &jpeg.Options{Quality: 90})
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, final, &jpeg.Options{Quality: 90}); err != nil {
+		return fmt.Errorf("error encoding image: %w", err)
+	}
+	return writeFileAtomic(outPath, func(w io.Writer) error {
+		// The metadata segments go right after the start of image marker.
+		data := encoded.Bytes()
+		for _, part := range [][]byte{data[:2], meta.jpegSegments(), data[2:]} {
+			if _, err := w.Write(part); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
@@ -1,32 +1,40 @@
 package app
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 )
 
 // mergeVideos merges a background video with an overlay using ffmpeg.
-func mergeVideos(bgData, ovData []byte, bName, oName, outPath string) {
-	tmpDir := os.TempDir()
-	bTmp, oTmp := filepath.Join(tmpDir, bName), filepath.Join(tmpDir, oName)
-	os.WriteFile(bTmp, bgData, 0644)
-	os.WriteFile(oTmp, ovData, 0644)
-	defer os.Remove(bTmp)
-	defer os.Remove(oTmp)
-	w, h := getVideoDimensions(bTmp)
+// The ffmpeg and ffprobe processes are killed when ctx is cancelled, and
+// ffmpeg writes to a temporary file that replaces outPath once it is
+// complete, see writeAtomic.
+func mergeVideos(ctx context.Context, bPath, oPath, outPath string) error {
+	w, h := getVideoDimensions(ctx, bPath)
 	if w == "" {
 		w, h = "540", "960"
 	}
 	filter := fmt.Sprintf("[1:v]scale=iw*%s/iw:ih*%s/ih[ovr];[0:v][ovr]overlay=0:0", w, h)
-	exec.Command("ffmpeg", "-i", bTmp, "-i", oTmp, "-filter_complex", filter, "-pix_fmt", "yuv420p", "-c:a", "copy", outPath, "-y").Run()
+	return writeAtomic(outPath, func(tmpPath string) error {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "ffmpeg", "-i", bPath, "-i", oPath, "-filter_complex", filter, "-pix_fmt", "yuv420p", "-c:a", "copy", tmpPath, "-y")
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("ffmpeg: %w: %s", err, lastLine(stderr.String()))
+		}
+		return nil
+	})
 }
 
 // getVideoDimensions extracts video width and height using ffprobe.
-func getVideoDimensions(path string) (string, string) {
-	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=s=x:p=0", path).Output()
+func getVideoDimensions(ctx context.Context, path string) (string, string) {
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=s=x:p=0", path).Output()
 	if err != nil {
 		return "", ""
 	}
@@ -36,3 +44,12 @@ func getVideoDimensions(path string) (string, string) {
 	}
 	return "", ""
 }
+
+// lastLine returns the last non-empty line of a command's output.
+func lastLine(output string) string {
+	output = strings.TrimSpace(output)
+	if i := strings.LastIndexByte(output, '\n'); i >= 0 {
+		return output[i+1:]
+	}
+	return output
+}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// downloadLinkRegex matches the onclick handler of the export's download links:
+// downloadMemories('<url>', this, <isGetRequest>).
+var downloadLinkRegex = regexp.MustCompile(`downloadMemories\('([^']+)'(?:\s*,\s*[^,)]*,\s*(true|false))?`)
+
+// htmlCell is a table cell with its text content and the link found in it.
+type htmlCell struct {
+	header bool
+	text   strings.Builder
+	link   string
+	isPost bool
+}
+
+// htmlRow is a table row as found in the document.
+type htmlRow struct {
+	cells []*htmlCell
+	raw   strings.Builder
+}
+
+// htmlTable collects the rows of one <table> element.
+type htmlTable struct {
+	rows []*htmlRow
+}
+
+// ParseHTML extracts memory items from the HTML content. It walks the
+// document with an HTML tokenizer, locates the memories table by its header
+// names (falling back to the table that holds download links) and reports
+// every row it could not interpret as a warning.
+func ParseHTML(content string) ParseResult {
+	tables := tokenizeTables(strings.NewReader(content))
+
+	var result ParseResult
+	// Rows are numbered like the entries of a JSON export: headers and
+	// empty rows do not count.
+	var n int
+	for _, table := range tables {
+		cols, ok := memoryColumns(table)
+		if !ok {
+			continue
+		}
+		for _, row := range table.rows {
+			if row.isHeader() || row.isEmpty() {
+				continue
+			}
+			n++
+			item, reason := parseHTMLRow(row, cols)
+			if reason != "" {
+				result.warn(n, row.raw.String(), reason)
+				continue
+			}
+			result.Items = append(result.Items, item)
+		}
+	}
+	return result
+}
+
+// tokenizeTables splits the document into tables, rows and cells. Missing end
+// tags are tolerated the same way browsers do: a new row or cell closes the
+// previous one.
+func tokenizeTables(r io.Reader) []*htmlTable {
+	var tables []*htmlTable
+	var stack []*htmlTable
+	var row *htmlRow
+	var cell *htmlCell
+
+	closeCell := func() { cell = nil }
+	closeRow := func() {
+		closeCell()
+		row = nil
+	}
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return tables
+		}
+		// Raw is only valid until the token is read. Start tags are recorded
+		// once a <tr> has opened its row, end tags before a </tr> closes it;
+		// </table> closes the row without being part of it.
+		raw := string(z.Raw())
+		tok := z.Token()
+		if tt == html.EndTagToken && tok.DataAtom != atom.Table && row != nil {
+			row.raw.WriteString(raw)
+		}
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch tok.DataAtom {
+			case atom.Table:
+				closeRow()
+				table := &htmlTable{}
+				tables = append(tables, table)
+				stack = append(stack, table)
+			case atom.Tr:
+				if len(stack) == 0 {
+					break
+				}
+				closeRow()
+				row = &htmlRow{}
+				table := stack[len(stack)-1]
+				table.rows = append(table.rows, row)
+			case atom.Td, atom.Th:
+				if row == nil {
+					break
+				}
+				cell = &htmlCell{header: tok.DataAtom == atom.Th}
+				row.cells = append(row.cells, cell)
+			case atom.Br:
+				if cell != nil {
+					cell.text.WriteByte(' ')
+				}
+			default:
+				if cell != nil && cell.link == "" {
+					cell.link, cell.isPost = linkFromAttrs(tok.Attr)
+				}
+			}
+		case html.EndTagToken:
+			switch tok.DataAtom {
+			case atom.Table:
+				closeRow()
+				if len(stack) > 0 {
+					stack = stack[:len(stack)-1]
+				}
+			case atom.Tr:
+				closeRow()
+			case atom.Td, atom.Th:
+				closeCell()
+			}
+		case html.TextToken:
+			if cell != nil {
+				cell.text.WriteString(tok.Data)
+			}
+		}
+		if tt != html.EndTagToken && row != nil {
+			row.raw.WriteString(raw)
+		}
+	}
+}
+
+// linkFromAttrs returns the download link carried by an element's attributes,
+// and whether it is a link that must be POSTed to obtain the media URL. Only
+// links passed to downloadMemories with isGetRequest set to true are media
+// URLs; without the argument the page POSTs to the link.
+func linkFromAttrs(attrs []html.Attribute) (string, bool) {
+	for _, attr := range attrs {
+		if attr.Key != "onclick" {
+			continue
+		}
+		if m := downloadLinkRegex.FindStringSubmatch(attr.Val); m != nil {
+			return m[1], m[2] != "true"
+		}
+	}
+	for _, attr := range attrs {
+		if attr.Key == "href" && (strings.HasPrefix(attr.Val, "http://") || strings.HasPrefix(attr.Val, "https://")) {
+			return attr.Val, false
+		}
+	}
+	return "", false
+}
+
+// value returns the cell's text with whitespace collapsed.
+func (c *htmlCell) value() string {
+	return strings.Join(strings.Fields(c.text.String()), " ")
+}
+
+// isHeader reports whether the row only holds header cells.
+func (r *htmlRow) isHeader() bool {
+	for _, c := range r.cells {
+		if !c.header {
+			return false
+		}
+	}
+	return len(r.cells) > 0
+}
+
+// isEmpty reports whether the row carries no text and no link at all.
+func (r *htmlRow) isEmpty() bool {
+	for _, c := range r.cells {
+		if c.value() != "" || c.link != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// htmlColumns maps the memories table's fields to cell positions.
+type htmlColumns struct {
+	date, mediaType, location int
+}
+
+// defaultColumns is the layout of Snapchat's export when no header row is present.
+var defaultColumns = htmlColumns{date: 0, mediaType: 1, location: 2}
+
+// memoryColumns reports whether table is a memories table and where its
+// columns are. Tables are recognised by a header row naming the Date and
+// Media Type columns, or, without headers, by rows holding download links.
+func memoryColumns(table *htmlTable) (htmlColumns, bool) {
+	for _, row := range table.rows {
+		if !row.isHeader() {
+			continue
+		}
+		cols := htmlColumns{date: -1, mediaType: -1, location: -1}
+		for i, c := range row.cells {
+			switch strings.ToLower(c.value()) {
+			case "date":
+				cols.date = i
+			case "media type", "type":
+				cols.mediaType = i
+			case "location":
+				cols.location = i
+			}
+		}
+		if cols.date >= 0 && cols.mediaType >= 0 {
+			return cols, true
+		}
+	}
+
+	for _, row := range table.rows {
+		for _, c := range row.cells {
+			if c.link != "" {
+				return defaultColumns, true
+			}
+		}
+	}
+	return htmlColumns{}, false
+}
+
+// parseHTMLRow converts a table row into a MemoryItem, or returns the reason it cannot.
+func parseHTMLRow(row *htmlRow, cols htmlColumns) (MemoryItem, string) {
+	cell := func(i int) string {
+		if i < 0 || i >= len(row.cells) {
+			return ""
+		}
+		return row.cells[i].value()
+	}
+	if len(row.cells) <= max(cols.date, cols.mediaType) {
+		return MemoryItem{}, fmt.Sprintf("expected at least %d columns, found %d", max(cols.date, cols.mediaType)+1, len(row.cells))
+	}
+
+	dateStr := cell(cols.date)
+	t, err := time.Parse("2006-01-02 15:04:05", strings.TrimSuffix(dateStr, " UTC"))
+	if err != nil {
+		return MemoryItem{}, fmt.Sprintf("invalid date %q", dateStr)
+	}
+
+	var link string
+	var isPost bool
+	for _, c := range row.cells {
+		if c.link != "" {
+			link, isPost = c.link, c.isPost
+			break
+		}
+	}
+	if link == "" {
+		return MemoryItem{}, "no download link"
+	}
+
+	mType := cell(cols.mediaType)
+	media := ParseMediaType(mType)
+	item := MemoryItem{Date: t, Type: mType, Media: media, Location: parseItemLocation(cell(cols.location)), Extension: media.Extension(), ID: NewItemID(t, link)}
+	// downloadMemories(url, button, isGetRequest): links that are not
+	// fetched with a GET must be POSTed to obtain the media URL.
+	if isPost {
+		item.DownloadLink = link
+	} else {
+		item.URL = link
+	}
+	return item, ""
+}
@@ -0,0 +1,225 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotStreamable is returned by OpenJSONStream for inputs that are not a JSON export.
+var ErrNotStreamable = errors.New("input is not a JSON export")
+
+// jsonMemoryItem is a helper struct for unmarshaling JSON input.
+type jsonMemoryItem struct {
+	Date             string `json:"Date"`
+	MediaType        string `json:"Media Type"`
+	Location         string `json:"Location"`
+	DownloadLink     string `json:"Download Link"`
+	MediaDownloadUrl string `json:"Media Download Url"`
+}
+
+// ParseJSON extracts memory items from JSON content. Entries that cannot be
+// interpreted are reported as warnings; only malformed JSON is an error.
+func ParseJSON(jsonData []byte) (ParseResult, error) {
+	var result ParseResult
+	err := decodeSavedMedia(json.NewDecoder(bytes.NewReader(jsonData)), func(row int, raw json.RawMessage) error {
+		item, reason := parseJSONEntry(raw)
+		if reason != "" {
+			result.warn(row, string(raw), reason)
+		} else {
+			result.Items = append(result.Items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return ParseResult{}, err
+	}
+	return result, nil
+}
+
+// decodeSavedMedia walks the export with dec, token by token, and calls fn
+// with every entry of its "Saved Media" array, so only one entry is held in
+// memory at a time. Other members of the document are skipped.
+func decodeSavedMedia(dec *json.Decoder, fn func(row int, raw json.RawMessage) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("error unmarshaling JSON: %w", err)
+		}
+		if key, _ := tok.(string); key != "Saved Media" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return fmt.Errorf("error unmarshaling JSON: %w", err)
+			}
+			continue
+		}
+
+		tok, err = dec.Token()
+		if err != nil {
+			return fmt.Errorf("error unmarshaling JSON: %w", err)
+		}
+		if tok == nil {
+			continue
+		}
+		if d, ok := tok.(json.Delim); !ok || d != '[' {
+			return fmt.Errorf("error unmarshaling JSON: expected \"Saved Media\" to be an array, found %v", tok)
+		}
+		for row := 1; dec.More(); row++ {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return fmt.Errorf("error unmarshaling JSON: %w", err)
+			}
+			if err := fn(row, raw); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// expectDelim reads the next token and checks that it is delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("error unmarshaling JSON: expected %q, found %v", delim, tok)
+	}
+	return nil
+}
+
+// parseJSONEntry converts an entry of the "Saved Media" array into a
+// MemoryItem, or returns the reason it cannot.
+func parseJSONEntry(raw json.RawMessage) (MemoryItem, string) {
+	var jItem jsonMemoryItem
+	if err := json.Unmarshal(raw, &jItem); err != nil {
+		return MemoryItem{}, fmt.Sprintf("invalid entry: %v", err)
+	}
+	t, err := time.Parse("2006-01-02 15:04:05 UTC", jItem.Date)
+	if err != nil {
+		return MemoryItem{}, fmt.Sprintf("invalid date %q", jItem.Date)
+	}
+
+	// The download link carries the stable memory identifiers, the
+	// media URL is only used when it is missing or lacks the media ID.
+	idURL := jItem.DownloadLink
+	if idURL == "" || linkMediaID(idURL) == "" && linkMediaID(jItem.MediaDownloadUrl) != "" {
+		idURL = jItem.MediaDownloadUrl
+	}
+	if idURL == "" {
+		return MemoryItem{}, "no download link"
+	}
+
+	media := ParseMediaType(jItem.MediaType)
+	return MemoryItem{
+		Date:         t,
+		Type:         strings.TrimSpace(jItem.MediaType),
+		Location:     parseItemLocation(jItem.Location),
+		URL:          jItem.MediaDownloadUrl,
+		Extension:    media.Extension(),
+		Media:        media,
+		DownloadLink: jItem.DownloadLink,
+		ID:           NewItemID(t, idURL),
+	}, ""
+}
+
+// JSONStream decodes a memories_history.json document in the background and
+// sends its items on a channel as they are decoded, so downloads can start
+// before the whole file is parsed. See NewStreamRunner.
+type JSONStream struct {
+	items  chan MemoryItem
+	done   chan struct{}
+	result ParseResult
+	err    error
+}
+
+// StreamJSON starts decoding r. Items are sent on Items in document order,
+// without duplicates; the channel is closed at the end of the document, on a
+// decoding error, or when ctx is canceled.
+func StreamJSON(ctx context.Context, r io.Reader) *JSONStream {
+	s := &JSONStream{items: make(chan MemoryItem), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer close(s.items)
+
+		seen := make(map[string]bool)
+		s.err = decodeSavedMedia(json.NewDecoder(r), func(row int, raw json.RawMessage) error {
+			item, reason := parseJSONEntry(raw)
+			if reason != "" {
+				s.result.warn(row, string(raw), reason)
+				return nil
+			}
+			if seen[item.ID] {
+				s.result.Duplicates++
+				return nil
+			}
+			seen[item.ID] = true
+
+			select {
+			case s.items <- item:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return s
+}
+
+// OpenJSONStream streams the JSON export at path, see StreamJSON. It returns
+// ErrNotStreamable for other inputs, which must be read with LoadInput.
+func OpenJSONStream(ctx context.Context, path string) (*JSONStream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	// Only UTF-8 exports are streamed; a UTF-8 byte order mark is skipped.
+	start := bytes.TrimPrefix(header[:n], []byte{0xEF, 0xBB, 0xBF})
+	if !bytes.HasPrefix(bytes.TrimSpace(start), []byte("{")) {
+		f.Close()
+		return nil, ErrNotStreamable
+	}
+	if _, err := f.Seek(int64(n-len(start)), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := StreamJSON(ctx, f)
+	go func() {
+		<-s.done
+		f.Close()
+	}()
+	return s, nil
+}
+
+// Items returns the channel the decoded items are sent on.
+func (s *JSONStream) Items() <-chan MemoryItem {
+	return s.items
+}
+
+// Wait blocks until decoding has finished and returns its warnings and
+// duplicate count; the items themselves were sent on Items. Items must be
+// drained, or the stream's context canceled, for Wait to return.
+func (s *JSONStream) Wait() (ParseResult, error) {
+	<-s.done
+	return s.result, s.err
+}
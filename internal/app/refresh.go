@@ -0,0 +1,60 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RefreshItems copies the download URLs, and any bundled media, of a freshly
+// exported file onto items whose links expired. Memories are matched by
+// capture time, media type and location; the original IDs are kept so the
+// journal still recognises the items. It returns the refreshed items and how many of them found a match.
+func RefreshItems(items, fresh []MemoryItem) ([]MemoryItem, int) {
+	byKey := make(map[string][]MemoryItem, len(fresh))
+	for _, item := range fresh {
+		key := matchKey(item)
+		byKey[key] = append(byKey[key], item)
+	}
+
+	refreshed := make([]MemoryItem, len(items))
+	matched := 0
+	for i, item := range items {
+		item.ID = itemID(item)
+		key := matchKey(item)
+		// Memories sharing a key are matched in export order.
+		if candidates := byKey[key]; len(candidates) > 0 {
+			item.URL, item.DownloadLink = candidates[0].URL, candidates[0].DownloadLink
+			if candidates[0].Bundled != nil {
+				item.Bundled = candidates[0].Bundled
+			}
+			byKey[key] = candidates[1:]
+			matched++
+		}
+		refreshed[i] = item
+	}
+	return refreshed, matched
+}
+
+// ReplaceItems returns items with those of updated, e.g. refreshed by
+// RefreshItems, put in place of the items with the same ID. Running the whole
+// input rather than only the updated items keeps the names that depend on the
+// other memories, such as {index} and collision suffixes, as in earlier runs.
+func ReplaceItems(items, updated []MemoryItem) []MemoryItem {
+	byID := make(map[string]MemoryItem, len(updated))
+	for _, item := range updated {
+		byID[itemID(item)] = item
+	}
+	replaced := make([]MemoryItem, len(items))
+	for i, item := range items {
+		if u, ok := byID[itemID(item)]; ok {
+			item = u
+		}
+		replaced[i] = item
+	}
+	return replaced
+}
+
+// matchKey identifies a memory independently of its download links.
+func matchKey(item MemoryItem) string {
+	return fmt.Sprintf("%d|%s|%s", item.Date.Unix(), strings.ToLower(strings.TrimSpace(item.Type)), item.Location.key())
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// URLResolver turns a memory's indirect download link into a short-lived
+// media URL that can be downloaded directly.
+type URLResolver interface {
+	Resolve(ctx context.Context, item MemoryItem) (string, error)
+}
+
+// ResolverFunc adapts an ordinary function to the URLResolver interface.
+type ResolverFunc func(ctx context.Context, item MemoryItem) (string, error)
+
+// Resolve calls f(ctx, item).
+func (f ResolverFunc) Resolve(ctx context.Context, item MemoryItem) (string, error) {
+	return f(ctx, item)
+}
+
+// PostLinkResolver implements the flow used by Snapchat's own export page: the
+// query string of the download link is POSTed as a form to the link's endpoint,
+// and the response body holds the CDN URL of the media.
+type PostLinkResolver struct {
+	// Client is used for the POST request; http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// Resolve POSTs the item's DownloadLink and returns the media URL from the response.
+func (r PostLinkResolver) Resolve(ctx context.Context, item MemoryItem) (string, error) {
+	if item.DownloadLink == "" {
+		return "", ErrNoURL
+	}
+	endpoint, query, _ := strings.Cut(item.DownloadLink, "?")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(query))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return "", err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+
+	mediaURL := strings.TrimSpace(string(body))
+	if u, err := url.Parse(mediaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("download link returned an invalid media URL %q", truncate(mediaURL, 80))
+	}
+	return mediaURL, nil
+}
+
+// resolver returns the configured URLResolver or the default PostLinkResolver.
+func resolver(config Config) URLResolver {
+	if config.Resolver != nil {
+		return config.Resolver
+	}
+	return PostLinkResolver{}
+}
+
+// fetchItem downloads the item's media into its .part file. When its links
+// fail, those of its Fallbacks are tried in turn; the error of its own links
+// is returned if none of them works.
+func fetchItem(ctx context.Context, item MemoryItem, config Config) (string, error) {
+	path, err := fetchLinks(ctx, item, config)
+	for _, links := range item.Fallbacks {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if path, ferr := fetchLinks(ctx, item.withLinks(links), config); ferr == nil {
+			return path, nil
+		}
+	}
+	return path, err
+}
+
+// fetchLinks downloads the media of the item's own links. Media bundled in
+// the export is extracted instead. Items without a direct URL are resolved
+// through their download link first, and a direct URL that is rejected
+// outright (for example because it expired) is retried once through the
+// download link.
+func fetchLinks(ctx context.Context, item MemoryItem, config Config) (string, error) {
+	if item.Bundled != nil {
+		return extractBundled(item, config)
+	}
+	if item.URL == "" && item.DownloadLink == "" {
+		return "", ErrNoURL
+	}
+
+	resolved := false
+	mediaURL := item.URL
+	if mediaURL == "" {
+		var err error
+		if mediaURL, err = resolveWithRetry(ctx, item, config); err != nil {
+			return "", fmt.Errorf("resolve download link: %w", err)
+		}
+		resolved = true
+	}
+
+	path, err := downloadPart(ctx, mediaURL, item.ID, config)
+	var httpErr *HTTPError
+	if err != nil && !resolved && item.DownloadLink != "" && errors.As(err, &httpErr) && !httpErr.Temporary() {
+		if mediaURL, rerr := resolveWithRetry(ctx, item, config); rerr == nil {
+			return downloadPart(ctx, mediaURL, item.ID, config)
+		}
+	}
+	return path, err
+}
+
+// resolveWithRetry resolves the item's download link, retrying transient failures.
+func resolveWithRetry(ctx context.Context, item MemoryItem, config Config) (string, error) {
+	var mediaURL string
+	err := withRetry(ctx, config, func() error {
+		var err error
+		mediaURL, err = resolver(config).Resolve(ctx, item)
+		return err
+	})
+	return mediaURL, err
+}
+
+// truncate shortens s to at most n bytes for use in error messages.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,321 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// EventKind identifies the pipeline stage reported by an Event.
+type EventKind int
+
+const (
+	// EventStarted is emitted when a worker picks up an item.
+	EventStarted EventKind = iota
+	// EventDownloaded is emitted once the item's media has been downloaded.
+	EventDownloaded
+	// EventMerged is emitted when an overlay was merged onto the media.
+	EventMerged
+	// EventMetadataApplied is emitted once metadata has been written to the output file.
+	EventMetadataApplied
+	// EventCompleted is emitted when an item has been fully processed.
+	EventCompleted
+	// EventFailed is emitted when an item could not be processed; Err holds the reason.
+	EventFailed
+	// EventSkipped is emitted for items that cannot be downloaded at all; Err holds the reason.
+	EventSkipped
+	// EventCanceled is emitted for items interrupted by cancelling the run.
+	EventCanceled
+)
+
+// String returns a human readable name for the event kind.
+func (k EventKind) String() string {
+	switch k {
+	case EventStarted:
+		return "started"
+	case EventDownloaded:
+		return "downloaded"
+	case EventMerged:
+		return "merged"
+	case EventMetadataApplied:
+		return "metadata applied"
+	case EventCompleted:
+		return "completed"
+	case EventFailed:
+		return "failed"
+	case EventSkipped:
+		return "skipped"
+	case EventCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports the progress of a single memory item through the pipeline.
+// Every started item produces exactly one terminal event: EventCompleted,
+// EventFailed, EventSkipped or EventCanceled.
+type Event struct {
+	Kind  EventKind
+	Item  MemoryItem
+	Index int    // position of the item in the runner's input
+	Path  string // output path, once known
+	Err   error  // set for EventFailed and EventSkipped
+}
+
+// Terminal reports whether the event is the last one emitted for its item.
+func (e Event) Terminal() bool {
+	switch e.Kind {
+	case EventCompleted, EventFailed, EventSkipped, EventCanceled:
+		return true
+	}
+	return false
+}
+
+// Summary holds the outcome counts of a run.
+type Summary struct {
+	Total     int
+	Succeeded int
+	Failed    int
+	Skipped   int
+	Canceled  int
+	// Expired counts failed items whose signed URL expired; see RefreshItems.
+	Expired int
+	// AlreadyDownloaded counts items a previous run completed, according to the journal.
+	AlreadyDownloaded int
+}
+
+// Done returns the number of items that reached a terminal state.
+func (s Summary) Done() int {
+	return s.Succeeded + s.Failed + s.Expired + s.Skipped + s.Canceled + s.AlreadyDownloaded
+}
+
+// String formats the summary for logs and dialogs.
+func (s Summary) String() string {
+	str := fmt.Sprintf("%d succeeded, %d failed, %d skipped", s.Succeeded, s.Failed, s.Skipped)
+	if s.Expired > 0 {
+		str += fmt.Sprintf(", %d expired", s.Expired)
+	}
+	if s.AlreadyDownloaded > 0 {
+		str += fmt.Sprintf(", %d already downloaded", s.AlreadyDownloaded)
+	}
+	if pending := s.Total - s.Done() + s.Canceled; pending > 0 {
+		str += fmt.Sprintf(", %d not processed", pending)
+	}
+	return str
+}
+
+// record updates the counts for a terminal event.
+func (s *Summary) record(ev Event) {
+	switch ev.Kind {
+	case EventCompleted:
+		s.Succeeded++
+	case EventFailed:
+		if errors.Is(ev.Err, ErrExpired) {
+			s.Expired++
+		} else {
+			s.Failed++
+		}
+	case EventSkipped:
+		if errors.Is(ev.Err, ErrAlreadyDownloaded) {
+			s.AlreadyDownloaded++
+		} else {
+			s.Skipped++
+		}
+	case EventCanceled:
+		s.Canceled++
+	}
+}
+
+// Runner processes memory items with a pool of workers and reports progress as events.
+type Runner struct {
+	config  Config
+	items   []MemoryItem
+	source  <-chan MemoryItem
+	journal *Journal
+
+	mu      sync.Mutex
+	summary Summary
+}
+
+// NewRunner creates a Runner for the given configuration and items.
+func NewRunner(config Config, items []MemoryItem) *Runner {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	return &Runner{config: config, items: items, summary: Summary{Total: len(items)}}
+}
+
+// NewStreamRunner creates a Runner that processes items as they arrive on
+// source, see JSONStream, so downloads can start while the input is still
+// being parsed. The total grows until source is closed.
+func NewStreamRunner(config Config, source <-chan MemoryItem) *Runner {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	return &Runner{config: config, source: source}
+}
+
+// SetJournal makes the runner record every outcome in j and skip items that
+// j lists as completed, unless Config.Redownload is set.
+func (r *Runner) SetJournal(j *Journal) {
+	r.journal = j
+}
+
+// Summary returns the outcome counts so far; it is final once the event channel is closed.
+func (r *Runner) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.summary
+}
+
+// Total returns the number of items the runner will process. For a runner
+// reading from a stream it is the number of items received so far.
+func (r *Runner) Total() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.summary.Total
+}
+
+// job is an item handed to a worker with its position in the input and the
+// suffix that sets its name apart from others named alike.
+type job struct {
+	idx    int
+	item   MemoryItem
+	suffix string
+}
+
+// Run starts processing all items and returns a channel of events.
+// The channel is closed once every started item has reached a terminal event.
+// Cancelling ctx stops dispatching new items and aborts the ones in flight.
+func (r *Runner) Run(ctx context.Context) <-chan Event {
+	events := make(chan Event, r.config.Concurrency*4)
+	jobs := make(chan job)
+
+	var wg sync.WaitGroup
+	for w := 0; w < r.config.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				r.process(ctx, j, events)
+			}
+		}()
+	}
+
+	go func() {
+		r.dispatch(ctx, jobs)
+		close(jobs)
+		wg.Wait()
+		// Only succeeds once every temporary download has been cleaned up.
+		os.Remove(tempDir(r.config))
+		close(events)
+	}()
+
+	return events
+}
+
+// dispatch hands the items to the workers until the input is exhausted or
+// ctx is canceled. Items claim their names in input order, see nameClaims.
+func (r *Runner) dispatch(ctx context.Context, jobs chan<- job) {
+	claims := newNameClaims(r.config, r.journal)
+	if r.source == nil {
+		for idx, item := range r.items {
+			select {
+			case jobs <- job{idx, item, claims.suffix(item, idx)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		return
+	}
+
+	for idx := 0; ; idx++ {
+		var item MemoryItem
+		select {
+		case next, ok := <-r.source:
+			if !ok {
+				return
+			}
+			item = next
+		case <-ctx.Done():
+			return
+		}
+		r.mu.Lock()
+		r.summary.Total++
+		r.mu.Unlock()
+
+		select {
+		case jobs <- job{idx, item, claims.suffix(item, idx)}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// process runs a single item through the pipeline, forwarding its stage events.
+func (r *Runner) process(ctx context.Context, j job, events chan<- Event) {
+	idx, item := j.idx, j.item
+	item.ID = itemID(item)
+	emit := func(kind EventKind, path string) {
+		events <- Event{Kind: kind, Item: item, Index: idx, Path: path}
+	}
+
+	if r.journal != nil && !r.config.Redownload {
+		if entry, ok := r.journal.Completed(item.ID); ok {
+			r.finish(Event{Kind: EventSkipped, Item: item, Index: idx, Path: entry.Path, Err: fmt.Errorf("%s: %w", item, ErrAlreadyDownloaded)}, events)
+			return
+		}
+	}
+
+	emit(EventStarted, "")
+	path, err := processItem(ctx, item, nameValues{index: idx, suffix: j.suffix}, r.config, emit)
+
+	ev := Event{Kind: EventCompleted, Item: item, Index: idx, Path: path, Err: err}
+	if err != nil && ctx.Err() != nil {
+		ev.Kind = EventCanceled
+	} else if errors.Is(err, ErrNoURL) {
+		ev.Kind = EventSkipped
+	} else if err != nil {
+		ev.Kind = EventFailed
+	}
+
+	if r.journal != nil && ev.Kind != EventCanceled {
+		if jerr := r.journal.Record(journalEntry(ev)); jerr != nil {
+			ev.Kind, ev.Err = EventFailed, fmt.Errorf("%s: journal: %w", item, jerr)
+		}
+	}
+	r.finish(ev, events)
+}
+
+// finish counts a terminal event and forwards it.
+func (r *Runner) finish(ev Event, events chan<- Event) {
+	r.mu.Lock()
+	r.summary.record(ev)
+	r.mu.Unlock()
+	events <- ev
+}
+
+// journalEntry converts a terminal event into its journal record.
+func journalEntry(ev Event) JournalEntry {
+	entry := JournalEntry{ID: ev.Item.ID}
+	switch ev.Kind {
+	case EventCompleted:
+		entry.State, entry.Path = JournalDone, ev.Path
+	case EventSkipped:
+		entry.State = JournalSkipped
+	case EventFailed:
+		entry.State = JournalFailed
+		if errors.Is(ev.Err, ErrExpired) {
+			entry.State = JournalExpired
+		}
+	default:
+		entry.State = JournalFailed
+	}
+	if ev.Err != nil {
+		entry.Error = ev.Err.Error()
+	}
+	return entry
+}
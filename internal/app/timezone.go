@@ -0,0 +1,286 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // zones must load on systems without a zoneinfo database
+)
+
+// TimeZone is the time zone memories are filed and named in. The zero value
+// is UTC, the time zone of the dates in an export.
+type TimeZone struct {
+	loc  *time.Location
+	auto bool
+}
+
+// AutoTimeZone is the name of the time zone inferred per memory from its location.
+const AutoTimeZone = "auto"
+
+// ParseTimeZone returns the time zone with the given name: an IANA zone such
+// as "Europe/Paris", "Local" for the system's zone, "auto" to infer the zone
+// of every memory from its location, or "" and "UTC" for UTC.
+func ParseTimeZone(name string) (TimeZone, error) {
+	switch name = strings.TrimSpace(name); {
+	case name == "", strings.EqualFold(name, "UTC"):
+		return TimeZone{}, nil
+	case strings.EqualFold(name, AutoTimeZone):
+		return TimeZone{auto: true}, nil
+	case strings.EqualFold(name, "Local"):
+		return TimeZone{loc: time.Local}, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return TimeZone{}, fmt.Errorf("unknown time zone %q", name)
+	}
+	return TimeZone{loc: loc}, nil
+}
+
+// String returns the name of the time zone.
+func (z TimeZone) String() string {
+	switch {
+	case z.auto:
+		return AutoTimeZone
+	case z.loc == nil:
+		return "UTC"
+	}
+	return z.loc.String()
+}
+
+// Location returns the time zone of the memory. An inferred time zone is
+// that of the zone boundary holding the memory's location, or the nautical
+// time zone of the longitude at sea; memories without a location stay in UTC.
+func (z TimeZone) Location(item MemoryItem) *time.Location {
+	switch {
+	case z.auto:
+		if !item.Location.Valid {
+			return time.UTC
+		}
+		return zoneAt(item.Location)
+	case z.loc == nil:
+		return time.UTC
+	}
+	return z.loc
+}
+
+// LocalTime returns the capture time of the memory in its time zone.
+func (z TimeZone) LocalTime(item MemoryItem) time.Time {
+	return item.Date.In(z.Location(item))
+}
+
+// boundariesData holds the outlines of the time zones on land, see
+// tzdata/gen.go for their source and encoding.
+//
+//go:generate go run tzdata/gen.go -o tzdata/boundaries.bin
+//go:embed tzdata/boundaries.bin
+var boundariesData []byte
+
+// boundaryScale is the number of boundary units in a degree.
+const boundaryScale = 1000
+
+// snapDistance is how far, in degrees, a location outside every zone may be
+// from the closest one to still take its zone. Simplified borders leave thin
+// gaps between neighbouring zones; farther from land, a location is at sea.
+const snapDistance = 0.02
+
+// zonePolygon is an area of a time zone: an outline and its holes, with
+// points in boundary units stored as longitude, latitude pairs.
+type zonePolygon struct {
+	zone                           int
+	rings                          [][]int32
+	minLon, minLat, maxLon, maxLat int32
+}
+
+// zoneBoundaries are the decoded boundaries of the time zones on land.
+type zoneBoundaries struct {
+	names    []string
+	polygons []zonePolygon
+}
+
+var (
+	boundariesOnce sync.Once
+	boundaries     zoneBoundaries
+	boundariesErr  error
+
+	zoneCacheMu sync.Mutex
+	zoneCache   = make(map[string]*time.Location)
+)
+
+// zoneAt returns the time zone at a location: the land zone whose boundary
+// contains it, or the nautical time zone of its longitude at sea.
+func zoneAt(loc Location) *time.Location {
+	boundariesOnce.Do(func() { boundaries, boundariesErr = decodeBoundaries(boundariesData) })
+
+	name := ""
+	if boundariesErr == nil {
+		name = boundaries.lookup(loc.Longitude*boundaryScale, loc.Latitude*boundaryScale)
+	}
+	if name == "" {
+		hours := int(math.Round(loc.Longitude / 15))
+		return time.FixedZone(fmt.Sprintf("UTC%+d", hours), hours*3600)
+	}
+
+	zoneCacheMu.Lock()
+	defer zoneCacheMu.Unlock()
+	if tz, ok := zoneCache[name]; ok {
+		return tz
+	}
+	tz, err := time.LoadLocation(name)
+	if err != nil {
+		tz = time.UTC
+	}
+	zoneCache[name] = tz
+	return tz
+}
+
+// lookup returns the name of the zone containing the point, or of the zone
+// closest to it within snapDistance, or "" at sea.
+func (b *zoneBoundaries) lookup(x, y float64) string {
+	const snap = snapDistance * boundaryScale
+	best, bestDist := -1, snap
+	for i := range b.polygons {
+		p := &b.polygons[i]
+		if x < float64(p.minLon)-snap || x > float64(p.maxLon)+snap ||
+			y < float64(p.minLat)-snap || y > float64(p.maxLat)+snap {
+			continue
+		}
+		if p.contains(x, y) {
+			return b.names[p.zone]
+		}
+		if d := p.distance(x, y); d < bestDist {
+			best, bestDist = p.zone, d
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return b.names[best]
+}
+
+// contains reports whether the point lies within the polygon, by counting
+// the edges of its outline and holes that a ray from the point crosses.
+func (p *zonePolygon) contains(x, y float64) bool {
+	if x < float64(p.minLon) || x > float64(p.maxLon) || y < float64(p.minLat) || y > float64(p.maxLat) {
+		return false
+	}
+	inside := false
+	for _, ring := range p.rings {
+		n := len(ring) / 2
+		for i, j := 0, n-1; i < n; j, i = i, i+1 {
+			xi, yi := float64(ring[2*i]), float64(ring[2*i+1])
+			xj, yj := float64(ring[2*j]), float64(ring[2*j+1])
+			if (yi > y) != (yj > y) && x < xi+(y-yi)*(xj-xi)/(yj-yi) {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// distance returns the distance from the point to the polygon's outline,
+// with longitudes shrunk by the cosine of the latitude so that distances
+// across and along meridians compare.
+func (p *zonePolygon) distance(x, y float64) float64 {
+	k := math.Cos(y / boundaryScale * math.Pi / 180)
+	outline := p.rings[0]
+	n := len(outline) / 2
+	best := math.Inf(1)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		ax, ay := float64(outline[2*j])*k, float64(outline[2*j+1])
+		bx, by := float64(outline[2*i])*k, float64(outline[2*i+1])
+		dx, dy := bx-ax, by-ay
+		px, py := x*k-ax, y-ay
+		if l := dx*dx + dy*dy; l > 0 {
+			t := math.Max(0, math.Min(1, (px*dx+py*dy)/l))
+			px, py = px-t*dx, py-t*dy
+		}
+		best = math.Min(best, math.Hypot(px, py))
+	}
+	return best
+}
+
+// decodeBoundaries reads the zone names and polygons of boundaries.bin.
+func decodeBoundaries(data []byte) (zoneBoundaries, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return zoneBoundaries{}, err
+	}
+	r := bufio.NewReader(zr)
+	var b zoneBoundaries
+	count := func() (int, error) {
+		n, err := binary.ReadUvarint(r)
+		if err == nil && n > math.MaxInt32 {
+			err = errors.New("invalid count in time zone boundaries")
+		}
+		return int(n), err
+	}
+
+	zones, err := count()
+	if err != nil {
+		return zoneBoundaries{}, err
+	}
+	for i := 0; i < zones; i++ {
+		n, err := count()
+		if err != nil {
+			return zoneBoundaries{}, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return zoneBoundaries{}, err
+		}
+		b.names = append(b.names, string(name))
+	}
+
+	polygons, err := count()
+	if err != nil {
+		return zoneBoundaries{}, err
+	}
+	b.polygons = make([]zonePolygon, polygons)
+	for i := range b.polygons {
+		p := &b.polygons[i]
+		var rings int
+		if p.zone, err = count(); err == nil {
+			rings, err = count()
+		}
+		if err != nil {
+			return zoneBoundaries{}, err
+		}
+		if p.zone >= len(b.names) || rings == 0 {
+			return zoneBoundaries{}, errors.New("invalid polygon in time zone boundaries")
+		}
+		p.minLon, p.minLat, p.maxLon, p.maxLat = math.MaxInt32, math.MaxInt32, math.MinInt32, math.MinInt32
+		for j := 0; j < rings; j++ {
+			points, err := count()
+			if err != nil {
+				return zoneBoundaries{}, err
+			}
+			ring := make([]int32, 2*points)
+			var x, y int64
+			for k := 0; k < points; k++ {
+				dx, err := binary.ReadVarint(r)
+				if err != nil {
+					return zoneBoundaries{}, err
+				}
+				dy, err := binary.ReadVarint(r)
+				if err != nil {
+					return zoneBoundaries{}, err
+				}
+				x, y = x+dx, y+dy
+				ring[2*k], ring[2*k+1] = int32(x), int32(y)
+				p.minLon, p.maxLon = min(p.minLon, int32(x)), max(p.maxLon, int32(x))
+				p.minLat, p.maxLat = min(p.minLat, int32(y)), max(p.maxLat, int32(y))
+			}
+			p.rings = append(p.rings, ring)
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,333 @@
+//go:build ignore
+
+// gen builds boundaries.bin, the time zone boundaries embedded by the app,
+// from the reduced timezone-boundary-builder polygons published by tzf-rel-lite.
+// The boundaries are © OpenStreetMap contributors, under the Open Database
+// License. Run go generate in internal/app to rebuild the file.
+//
+// The polygons are simplified further and quantized to a thousandth of a
+// degree. Zones at sea (Etc/GMT±N) are left out: the app falls back to the
+// nautical time zone of the longitude wherever no land zone applies.
+//
+// boundaries.bin is a gzip stream of unsigned and zigzag varints:
+//
+//	zone count, then per zone: name length, name
+//	polygon count, then per polygon: zone index, ring count
+//	    per ring: point count, then per point: longitude and latitude in
+//	    thousandths of a degree, as differences from the previous point
+//
+// The first ring of a polygon is its outline, the others its holes. Rings are
+// not closed: the last point connects back to the first.
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	module  = "github.com/ringsaturn/tzf-rel-lite@v0.0.2025-b2"
+	dataset = "combined-with-oceans.reduce.bin"
+
+	scale     = 1000  // units per degree
+	tolerance = 0.005 // simplification tolerance, in degrees
+)
+
+type point struct{ lon, lat float64 }
+
+type polygon struct {
+	zone  int
+	rings [][]point
+}
+
+func main() {
+	input := flag.String("i", "", "tzf Timezones file (default: "+dataset+" of "+module+")")
+	output := flag.String("o", "boundaries.bin", "output file")
+	flag.Parse()
+
+	path := *input
+	if path == "" {
+		var err error
+		if path, err = download(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names, polygons, err := readTimezones(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := write(*output, names, polygons); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d zones, %d polygons written to %s\n", len(names), len(polygons), *output)
+}
+
+// download fetches the dataset's module with the go command and returns the
+// path of the dataset.
+func download() (string, error) {
+	out, err := exec.Command("go", "mod", "download", "-json", module).Output()
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", module, err)
+	}
+	var info struct{ Dir, Error string }
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", err
+	}
+	if info.Error != "" {
+		return "", fmt.Errorf("downloading %s: %s", module, info.Error)
+	}
+	return filepath.Join(info.Dir, dataset), nil
+}
+
+// readTimezones decodes the land zones of a tzf.v1.Timezones message.
+func readTimezones(data []byte) ([]string, []polygon, error) {
+	var names []string
+	var polygons []polygon
+	err := forEachField(data, func(num int, value []byte) error {
+		if num != 1 { // Timezones.timezones
+			return nil
+		}
+		var name string
+		var rings [][][]point
+		err := forEachField(value, func(num int, value []byte) error {
+			switch num {
+			case 1: // Timezone.polygons
+				r, err := readPolygon(value)
+				rings = append(rings, r)
+				return err
+			case 2: // Timezone.name
+				name = string(value)
+			}
+			return nil
+		})
+		if err != nil || strings.HasPrefix(name, "Etc/") {
+			return err
+		}
+
+		zone := len(names)
+		names = append(names, name)
+		for _, r := range rings {
+			if p := simplifyPolygon(zone, r); p.rings != nil {
+				polygons = append(polygons, p)
+			}
+		}
+		return nil
+	})
+	return names, polygons, err
+}
+
+// readPolygon decodes a tzf.v1.Polygon into its outline and holes.
+func readPolygon(data []byte) ([][]point, error) {
+	var outline []point
+	var holes [][]point
+	err := forEachField(data, func(num int, value []byte) error {
+		switch num {
+		case 1: // Polygon.points
+			p, err := readPoint(value)
+			outline = append(outline, p)
+			return err
+		case 2: // Polygon.holes, whose own holes are always empty
+			hole, err := readPolygon(value)
+			if len(hole) > 0 {
+				holes = append(holes, hole[0])
+			}
+			return err
+		}
+		return nil
+	})
+	return append([][]point{outline}, holes...), err
+}
+
+// readPoint decodes a tzf.v1.Point, whose coordinates are 32-bit floats.
+func readPoint(data []byte) (point, error) {
+	var p point
+	err := forEachField(data, func(num int, value []byte) error {
+		if len(value) != 4 {
+			return fmt.Errorf("unexpected point field %d", num)
+		}
+		v := float64(math.Float32frombits(binary.LittleEndian.Uint32(value)))
+		if num == 1 {
+			p.lon = v
+		} else {
+			p.lat = v
+		}
+		return nil
+	})
+	return p, err
+}
+
+// forEachField calls fn with the number and the payload of every field of a
+// protobuf message. Varints are not needed and skipped.
+func forEachField(data []byte, fn func(num int, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		num := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint in field %d", num)
+			}
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fmt.Errorf("invalid length of field %d", num)
+			}
+			if err := fn(num, data[n:n+int(length)]); err != nil {
+				return err
+			}
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return fmt.Errorf("truncated field %d", num)
+			}
+			if err := fn(num, data[:4]); err != nil {
+				return err
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", key&7, num)
+		}
+	}
+	return nil
+}
+
+// simplifyPolygon simplifies and quantizes the rings of a polygon, dropping
+// holes that collapse. The polygon is dropped when its outline collapses.
+func simplifyPolygon(zone int, rings [][]point) polygon {
+	p := polygon{zone: zone}
+	for i, ring := range rings {
+		ring = quantize(simplify(ring))
+		if len(ring) < 3 {
+			if i == 0 {
+				return polygon{}
+			}
+			continue
+		}
+		p.rings = append(p.rings, ring)
+	}
+	return p
+}
+
+// simplify applies the Douglas-Peucker algorithm to a ring.
+func simplify(ring []point) []point {
+	if len(ring) < 4 {
+		return ring
+	}
+	keep := make([]bool, len(ring))
+	keep[0], keep[len(ring)-1] = true, true
+	var split func(a, b int)
+	split = func(a, b int) {
+		farthest, dist := -1, tolerance
+		for i := a + 1; i < b; i++ {
+			if d := segmentDistance(ring[i], ring[a], ring[b]); d > dist {
+				farthest, dist = i, d
+			}
+		}
+		if farthest >= 0 {
+			keep[farthest] = true
+			split(a, farthest)
+			split(farthest, b)
+		}
+	}
+	split(0, len(ring)-1)
+
+	var out []point
+	for i, k := range keep {
+		if k {
+			out = append(out, ring[i])
+		}
+	}
+	return out
+}
+
+// segmentDistance returns the distance from p to the segment from a to b.
+func segmentDistance(p, a, b point) float64 {
+	dx, dy := b.lon-a.lon, b.lat-a.lat
+	px, py := p.lon-a.lon, p.lat-a.lat
+	if l := dx*dx + dy*dy; l > 0 {
+		t := math.Max(0, math.Min(1, (px*dx+py*dy)/l))
+		px, py = px-t*dx, py-t*dy
+	}
+	return math.Hypot(px, py)
+}
+
+// quantize rounds the points of a ring to the stored precision, dropping
+// repeated points and the closing point equal to the first.
+func quantize(ring []point) []point {
+	var out []point
+	for _, p := range ring {
+		q := point{math.Round(p.lon * scale), math.Round(p.lat * scale)}
+		if len(out) == 0 || q != out[len(out)-1] {
+			out = append(out, q)
+		}
+	}
+	if len(out) > 1 && out[0] == out[len(out)-1] {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// write encodes the zones and polygons into a gzip compressed file.
+func write(path string, names []string, polygons []polygon) error {
+	var buf []byte
+	uvarint := func(v int) { buf = binary.AppendUvarint(buf, uint64(v)) }
+
+	uvarint(len(names))
+	for _, name := range names {
+		uvarint(len(name))
+		buf = append(buf, name...)
+	}
+	uvarint(len(polygons))
+	for _, p := range polygons {
+		uvarint(p.zone)
+		uvarint(len(p.rings))
+		for _, ring := range p.rings {
+			uvarint(len(ring))
+			var prev point
+			for _, q := range ring {
+				buf = binary.AppendVarint(buf, int64(q.lon-prev.lon))
+				buf = binary.AppendVarint(buf, int64(q.lat-prev.lat))
+				prev = q
+			}
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := zw.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
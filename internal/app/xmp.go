@@ -0,0 +1,277 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// xmpNamespace is the namespace of the properties that only Snapchat memories have.
+const xmpNamespace = "https://github.com/DrissiReda/snap-memory-downloader/ns/1.0/"
+
+// xmpProperty is a property of a memory's XMP metadata.
+type xmpProperty struct {
+	prefix, name, value string
+}
+
+// xmpNamespaces are the namespaces of the prefixes of xmpProperty, in the
+// order they are declared.
+var xmpNamespaces = []struct{ prefix, uri string }{
+	{"xmp", "http://ns.adobe.com/xap/1.0/"},
+	{"photoshop", "http://ns.adobe.com/photoshop/1.0/"},
+	{"exif", "http://ns.adobe.com/exif/1.0/"},
+	{"snap", xmpNamespace},
+}
+
+// rdfNamespace is the namespace of the RDF syntax XMP is written in.
+const rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+// xmpProperties returns the XMP properties of a memory: its local capture
+// time, location, Snapchat media type, IDs and whether an overlay was merged
+// into it.
+func xmpProperties(item MemoryItem, local time.Time, merged bool) []xmpProperty {
+	date := local.Format("2006-01-02T15:04:05-07:00")
+	props := []xmpProperty{
+		{"xmp", "CreateDate", date},
+		{"photoshop", "DateCreated", date},
+		{"exif", "DateTimeOriginal", date},
+	}
+	if item.Location.Valid {
+		props = append(props,
+			xmpProperty{"exif", "GPSLatitude", xmpCoordinate(item.Location.Latitude, "N", "S")},
+			xmpProperty{"exif", "GPSLongitude", xmpCoordinate(item.Location.Longitude, "E", "W")})
+	}
+	props = append(props, xmpProperty{"snap", "MediaType", item.Type}, xmpProperty{"snap", "ID", itemID(item)})
+	if mid := mediaID(item); mid != "" {
+		props = append(props, xmpProperty{"snap", "MediaID", mid})
+	}
+	return append(props, xmpProperty{"snap", "Overlay", fmt.Sprintf("%t", merged)})
+}
+
+// xmpDescription returns the rdf:Description holding the properties.
+func xmpDescription(props []xmpProperty) string {
+	var b strings.Builder
+	b.WriteString(`  <rdf:Description rdf:about=""`)
+	for _, ns := range xmpNamespaces {
+		fmt.Fprintf(&b, "\n    xmlns:%s=\"%s\"", ns.prefix, ns.uri)
+	}
+	for _, p := range props {
+		fmt.Fprintf(&b, "\n    %s:%s=\"", p.prefix, p.name)
+		xml.EscapeText(&b, []byte(p.value))
+		b.WriteString(`"`)
+	}
+	b.WriteString("/>\n")
+	return b.String()
+}
+
+// removeXMPProperties returns the XMP packet without the given properties,
+// whether they are written as attributes of an rdf:Description or as its
+// elements, and whatever prefix their namespace is bound to.
+func removeXMPProperties(packet []byte, props []xmpProperty) ([]byte, error) {
+	uris := make(map[string]string)
+	for _, ns := range xmpNamespaces {
+		uris[ns.prefix] = ns.uri
+	}
+	remove := make(map[xml.Name]bool)
+	for _, p := range props {
+		remove[xml.Name{Space: uris[p.prefix], Local: p.name}] = true
+	}
+	description := xml.Name{Space: rdfNamespace, Local: "Description"}
+
+	// RawToken leaves prefixes unresolved, so declarations are tracked here.
+	var scopes []map[string]string
+	resolve := func(n xml.Name) xml.Name {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if uri, ok := scopes[i][n.Space]; ok {
+				return xml.Name{Space: uri, Local: n.Local}
+			}
+		}
+		return n
+	}
+
+	var out bytes.Buffer
+	var parents []xml.Name
+	var copied int64 // packet[:copied] is written to out or dropped
+	var skip int     // depth within a removed element
+	d := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		start := d.InputOffset()
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		end := d.InputOffset()
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			scope := make(map[string]string)
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" {
+					scope[a.Name.Local] = a.Value
+				} else if a.Name.Space == "" && a.Name.Local == "xmlns" {
+					scope[""] = a.Value
+				}
+			}
+			scopes = append(scopes, scope)
+			name := resolve(t.Name)
+
+			switch {
+			case skip > 0:
+				skip++
+			case len(parents) > 0 && parents[len(parents)-1] == description && remove[name]:
+				out.Write(packet[copied:start])
+				copied, skip = end, 1
+			case name == description:
+				kept := t.Attr[:0:0]
+				for _, a := range t.Attr {
+					if a.Name.Space == "" || a.Name.Space == "xmlns" || !remove[resolve(a.Name)] {
+						kept = append(kept, a)
+					}
+				}
+				if len(kept) < len(t.Attr) {
+					out.Write(packet[copied:start])
+					writeXMLStartTag(&out, t.Name, kept, bytes.HasSuffix(packet[start:end], []byte("/>")))
+					copied = end
+				}
+			}
+			parents = append(parents, name)
+		case xml.EndElement:
+			if len(parents) == 0 {
+				return nil, errors.New("unexpected end element in XMP packet")
+			}
+			parents, scopes = parents[:len(parents)-1], scopes[:len(scopes)-1]
+			if skip > 0 {
+				if skip--; skip == 0 {
+					copied = end
+				}
+			}
+		}
+	}
+	out.Write(packet[copied:])
+	return out.Bytes(), nil
+}
+
+// writeXMLStartTag writes a start tag with names as found in the document.
+func writeXMLStartTag(w *bytes.Buffer, name xml.Name, attrs []xml.Attr, selfClosing bool) {
+	qualified := func(n xml.Name) string {
+		if n.Space == "" {
+			return n.Local
+		}
+		return n.Space + ":" + n.Local
+	}
+	w.WriteString("<" + qualified(name))
+	for _, a := range attrs {
+		w.WriteString(" " + qualified(a.Name) + `="`)
+		xml.EscapeText(w, []byte(a.Value))
+		w.WriteString(`"`)
+	}
+	if selfClosing {
+		w.WriteString("/>")
+	} else {
+		w.WriteString(">")
+	}
+}
+
+// xmpCoordinate formats a coordinate as XMP's "DDD,MM.mmmmmmK".
+func xmpCoordinate(value float64, positive, negative string) string {
+	ref := positive
+	if value < 0 {
+		ref, value = negative, -value
+	}
+	deg := math.Floor(value)
+	return fmt.Sprintf("%d,%.6f%s", int(deg), (value-deg)*60, ref)
+}
+
+// xmpPacket wraps descriptions into a complete XMP packet.
+func xmpPacket(descriptions string) []byte {
+	return []byte("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+		"<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n" +
+		" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n" +
+		descriptions +
+		" </rdf:RDF>\n" +
+		"</x:xmpmeta>\n" +
+		"<?xpacket end=\"w\"?>")
+}
+
+// writeXMPSidecar writes the memory's XMP metadata next to the file at path,
+// under each name of xmpSidecarPaths.
+func writeXMPSidecar(path string, item MemoryItem, local time.Time, merged bool) error {
+	packet := xmpPacket(xmpDescription(xmpProperties(item, local, merged)))
+	for _, sidecar := range xmpSidecarPaths(path) {
+		err := writeFileAtomic(sidecar, func(w io.Writer) error {
+			_, err := w.Write(packet)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xmpSidecarPaths returns the names tools look for the XMP sidecar of the
+// file at path under: path with ".xmp" appended, read by darktable and
+// digiKam, and path with its extension replaced, read by Lightroom, Bridge
+// and Capture One.
+func xmpSidecarPaths(path string) []string {
+	return []string{path + ".xmp", strings.TrimSuffix(path, filepath.Ext(path)) + ".xmp"}
+}
+
+// embedXMP adds the memory's XMP metadata to the APP1 segment of the JPEG
+// image at path. A packet already in the image, e.g. carried over from the
+// original by an overlay merge, keeps its other properties while ours replace
+// those it has, unless it cannot be read or that makes it too large for the
+// segment.
+func embedXMP(path string, item MemoryItem, local time.Time, merged bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if DetectContainer(data) != ContainerJPEG {
+		return nil
+	}
+
+	props := xmpProperties(item, local, merged)
+	description := xmpDescription(props)
+	packet := xmpPacket(description)
+	// Segments go after the leading APP0 (JFIF) and APP1 (EXIF) segments.
+	start, end := 2, 2
+	forEachJPEGSegment(data, func(marker byte, segStart, segEnd int) {
+		payload := data[segStart+4 : segEnd]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte(xmpPrefix)):
+			existing, err := removeXMPProperties(payload[len(xmpPrefix):], props)
+			if i := bytes.LastIndex(existing, []byte("</rdf:RDF>")); err == nil && i >= 0 {
+				packet = append(append(existing[:i:i], description...), existing[i:]...)
+			}
+			start, end = segStart, segEnd
+		case start == end && start == segStart && (marker == 0xE0 || marker == 0xE1):
+			start, end = segEnd, segEnd
+		}
+	})
+	if len(xmpPrefix)+len(packet) > maxSegmentPayload {
+		packet = xmpPacket(description)
+	}
+
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(2+len(xmpPrefix)+len(packet)))
+	segment = append(append(segment, xmpPrefix...), packet...)
+	return writeFileAtomic(path, func(w io.Writer) error {
+		for _, part := range [][]byte{data[:start], segment, data[end:]} {
+			if _, err := w.Write(part); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
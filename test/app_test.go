@@ -1,9 +1,25 @@
 package test
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"snap-memory-downloader/internal/app"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -29,23 +45,25 @@ func TestParseHTML(t *testing.T) {
 	`
 	expected := []app.MemoryItem{
 		{
-			Date:      time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC),
-			Type:      "Test Type",
-			Latitude:  "34.052235",
-			Longitude: "-118.243683",
-			URL:       "http://example.com/memory1.jpg",
-			Extension: ".jpg",
+			Date:         time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC),
+			Type:         "Test Type",
+			Location:     app.Location{Latitude: 34.052235, Longitude: -118.243683, Valid: true},
+			DownloadLink: "http://example.com/memory1.jpg",
+			Extension:    ".jpg",
 		},
 		{
-			Date:      time.Date(2023, 10, 28, 11, 0, 0, 0, time.UTC),
-			Type:      "Test Video",
-			Latitude:  "40.712776",
-			Longitude: "-74.005974",
-			URL:       "http://example.com/memory2.mp4",
-			Extension: ".mp4",
+			Date:         time.Date(2023, 10, 28, 11, 0, 0, 0, time.UTC),
+			Type:         "Test Video",
+			Location:     app.Location{Latitude: 40.712776, Longitude: -74.005974, Valid: true},
+			DownloadLink: "http://example.com/memory2.mp4",
+			Extension:    ".mp4",
 		},
 	}
-	items := app.ParseHTML(html)
+	result := app.ParseHTML(html)
+	if len(result.Warnings) != 0 {
+		t.Errorf("Expected no warnings, but got %v", result.Warnings)
+	}
+	items := result.Items
 	if len(items) != len(expected) {
 		t.Fatalf("Expected %d items, but got %d", len(expected), len(items))
 	}
@@ -56,14 +74,11 @@ func TestParseHTML(t *testing.T) {
 		if item.Type != expected[i].Type {
 			t.Errorf("Item %d: Expected type %s, but got %s", i, expected[i].Type, item.Type)
 		}
-		if item.Latitude != expected[i].Latitude {
-			t.Errorf("Item %d: Expected latitude %s, but got %s", i, expected[i].Latitude, item.Latitude)
-		}
-		if item.Longitude != expected[i].Longitude {
-			t.Errorf("Item %d: Expected longitude %s, but got %s", i, expected[i].Longitude, item.Longitude)
+		if item.Location != expected[i].Location {
+			t.Errorf("Item %d: Expected location %s, but got %s", i, expected[i].Location, item.Location)
 		}
-		if item.URL != expected[i].URL {
-			t.Errorf("Item %d: Expected URL %s, but got %s", i, expected[i].URL, item.URL)
+		if item.URL != "" || item.DownloadLink != expected[i].DownloadLink {
+			t.Errorf("Item %d: Expected link %s to be POSTed, but got URL %q and link %q", i, expected[i].DownloadLink, item.URL, item.DownloadLink)
 		}
 		if item.Extension != expected[i].Extension {
 			t.Errorf("Item %d: Expected extension %s, but got %s", i, expected[i].Extension, item.Extension)
@@ -71,6 +86,31 @@ func TestParseHTML(t *testing.T) {
 	}
 }
 
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    app.Location
+		wantErr bool
+	}{
+		{"Latitude, Longitude: 48.8584, 2.2945", app.Location{Latitude: 48.8584, Longitude: 2.2945, Valid: true}, false},
+		{"Latitude, Longitude: -33.86, 151.21 ± 14.5 meters", app.Location{Latitude: -33.86, Longitude: 151.21, Accuracy: 14.5, Valid: true}, false},
+		{"Latitude, Longitude: 0.0, 0.0", app.Location{}, false},
+		{"", app.Location{}, false},
+		{"Latitude, Longitude: 95.0, 10.0", app.Location{}, true},
+		{"Latitude, Longitude: 45.0, -190.0", app.Location{}, true},
+		{"Latitude, Longitude: 45.0", app.Location{}, true},
+	}
+	for _, test := range tests {
+		got, err := app.ParseLocation(test.text)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseLocation(%q): expected error %v, but got %v", test.text, test.wantErr, err)
+		}
+		if got != test.want {
+			t.Errorf("ParseLocation(%q): expected %s, but got %s", test.text, test.want, got)
+		}
+	}
+}
+
 func TestStripTags(t *testing.T) {
 	input := "<p>Hello, <b>world</b>!</p>"
 	expected := "Hello, world!"
@@ -86,7 +126,7 @@ func TestDownloadFile(t *testing.T) {
 	}))
 	defer server.Close()
 
-	data, err := app.DownloadFile(server.URL)
+	data, err := app.DownloadFile(context.Background(), server.URL)
 	if err != nil {
 		t.Fatalf("Expected no error, but got %v", err)
 	}
@@ -160,3 +200,1661 @@ func TestFormatDateCustomEdgeCases(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadInputFile(t *testing.T) {
+	dir := t.TempDir()
+
+	jsonPath := filepath.Join(dir, "memories_history.json")
+	jsonData := `{"Saved Media": [{"Date": "2023-10-27 10:00:00 UTC", "Media Type": "Video", "Location": "Latitude, Longitude: 1.5, 2.5", "Media Download Url": "http://example.com/v"}]}`
+	if err := os.WriteFile(jsonPath, []byte(jsonData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := app.LoadInput(jsonPath)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	items := result.Items
+	if len(items) != 1 || items[0].Extension != ".mp4" || items[0].URL != "http://example.com/v" {
+		t.Errorf("Unexpected items parsed from JSON: %+v", items)
+	}
+
+	txtPath := filepath.Join(dir, "memories.txt")
+	if err := os.WriteFile(txtPath, []byte("nothing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.LoadInput(txtPath); err == nil {
+		t.Errorf("Expected an error for an unsupported file type")
+	}
+}
+
+func TestLoadInput(t *testing.T) {
+	jsonData := `{"Saved Media": [{"Date": "2023-10-27 10:00:00 UTC", "Media Type": "Image", "Location": "", "Media Download Url": "http://example.com/café"}]}`
+	htmlRow := `<tr><td>2023-10-27 10:00:00 UTC</td><td>%s</td><td></td><td><a onclick="downloadMemories('http://example.com/a', this, true)">Download</a></td></tr>`
+
+	utf16 := func(s string, bigEndian bool) []byte {
+		var out []byte
+		for _, r := range s {
+			if bigEndian {
+				out = append(out, byte(r>>8), byte(r))
+			} else {
+				out = append(out, byte(r), byte(r>>8))
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		name     string
+		content  []byte
+		wantType string
+	}{
+		{"memories_history.HTML", []byte("<html><table>" + fmt.Sprintf(htmlRow, "Image") + "</table></html>"), "Image"},
+		{"memories.htm", []byte("\ufeff<table>" + fmt.Sprintf(htmlRow, "Image") + "</table>"), "Image"},
+		{"export", []byte(jsonData), "Image"},
+		{"memories_history.json", append([]byte{0xEF, 0xBB, 0xBF}, jsonData...), "Image"},
+		{"utf16le.json", append([]byte{0xFF, 0xFE}, utf16(jsonData, false)...), "Image"},
+		{"utf16be.json", utf16(jsonData, true), "Image"},
+		{"latin1.html", append([]byte(`<meta charset="iso-8859-1"><table>`), fmt.Sprintf(htmlRow, "Caf\xe9")+"</table>"...), "Café"},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, test.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, err := app.LoadInput(path)
+		if err != nil {
+			t.Errorf("%s: expected no error, but got %v", test.name, err)
+			continue
+		}
+		if len(result.Items) != 1 || result.Items[0].Type != test.wantType {
+			t.Errorf("%s: expected one %q item, but got %+v", test.name, test.wantType, result.Items)
+		}
+	}
+
+	path := filepath.Join(dir, "notes.json")
+	if err := os.WriteFile(path, []byte(`{"notes": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.LoadInput(path); err == nil {
+		t.Errorf("Expected an error for JSON that is not a memories export")
+	}
+}
+
+func TestLoadInputsMerge(t *testing.T) {
+	dir := t.TempDir()
+	older := filepath.Join(dir, "older.json")
+	newer := filepath.Join(dir, "newer.json")
+	files := map[string]string{
+		older: `{"Saved Media": [
+			{"Date": "2023-10-27 10:00:00 UTC", "Media Type": "Image", "Location": "", "Download Link": "https://example.com/dmd?mid=a&sig=1"},
+			{"Date": "2023-10-28 11:00:00 UTC", "Media Type": "Image", "Location": "", "Download Link": "https://example.com/dmd?mid=b&sig=1"}
+		]}`,
+		newer: `{"Saved Media": [
+			{"Date": "2023-10-28 11:00:00 UTC", "Media Type": "Image", "Location": "", "Download Link": "https://example.com/dmd?mid=b&sig=2", "Media Download Url": "https://cdn.example.com/b"},
+			{"Date": "2023-10-29 12:00:00 UTC", "Media Type": "Video", "Location": "", "Download Link": "https://example.com/dmd?mid=c&sig=2"},
+			{"Date": "not a date", "Media Type": "Video", "Location": ""}
+		]}`,
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := app.LoadInputs([]string{older, newer})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if got := result.String(); got != "3 parsed, 1 skipped, 1 duplicates" {
+		t.Errorf("Unexpected merge result %q", got)
+	}
+	if len(result.Items) == 3 && result.Items[1].URL != "https://cdn.example.com/b" {
+		t.Errorf("Expected the duplicate to fill in the missing media URL, got %+v", result.Items[1])
+	}
+	if len(result.Warnings) == 1 && !strings.HasPrefix(result.Warnings[0].String(), "newer.json row 3:") {
+		t.Errorf("Expected the warning to name its file, got %q", result.Warnings[0])
+	}
+}
+
+func TestLoadInputsMergeHTMLAndJSON(t *testing.T) {
+	dir := t.TempDir()
+	htmlPath := filepath.Join(dir, "memories_history.html")
+	jsonPath := filepath.Join(dir, "memories_history.json")
+	// The HTML export links the media itself, the JSON export the page that
+	// hands it out; both carry the same media ID, in different case.
+	htmlData := `<table><tr><th>Date</th><th>Media Type</th><th>Location</th><th></th></tr>
+		<tr><td>2023-10-27 10:00:00 UTC</td><td>Image</td><td></td>
+		<td><a onclick="downloadMemories('https://us-east1-aws.api.snapchat.com/dmd/mm?uid=u&amp;sid=s1&amp;mid=AAA-1&amp;ts=1700000000&amp;sig=x', this, true)">Download</a></td></tr>
+		<tr><td>2023-10-28 11:00:00 UTC</td><td>Video</td><td></td>
+		<td><a onclick="downloadMemories('https://us-east1-aws.api.snapchat.com/dmd/mm?uid=u&amp;sid=s2&amp;mid=BBB-2&amp;ts=1700000000&amp;sig=y', this, true)">Download</a></td></tr>
+	</table>`
+	jsonData := `{"Saved Media": [
+		{"Date": "2023-10-27 10:00:00 UTC", "Media Type": "Image", "Location": "", "Download Link": "https://app.snapchat.com/dmd/memories?uid=u&sid=s1&mid=aaa-1&ts=1800000000&sig=z"},
+		{"Date": "2023-10-29 12:00:00 UTC", "Media Type": "Image", "Location": "", "Download Link": "https://app.snapchat.com/dmd/memories?uid=u&sid=s3&mid=CCC-3&ts=1800000000&sig=z"}
+	]}`
+	for path, data := range map[string]string{htmlPath: htmlData, jsonPath: jsonData} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := app.LoadInputs([]string{htmlPath, jsonPath})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if got := result.String(); got != "3 parsed, 0 skipped, 1 duplicates" {
+		t.Errorf("Expected the memory in both exports to be merged, got %q", got)
+	}
+	if len(result.Items) == 3 {
+		// The JSON export was signed later, so its link is tried first.
+		first := result.Items[0]
+		if first.URL != "" || !strings.Contains(first.DownloadLink, "/dmd/memories?") ||
+			len(first.Fallbacks) != 1 || !strings.Contains(first.Fallbacks[0].URL, "/dmd/mm?") {
+			t.Errorf("Expected the merged memory to keep both links, got %+v", first)
+		}
+	}
+}
+
+func TestMergeResultsPrefersNewestLinks(t *testing.T) {
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	memory := func(ts string) app.MemoryItem {
+		return app.MemoryItem{Date: date, Type: "Image", Extension: ".jpg", ID: "a", URL: "https://cdn.example.com/a?ts=" + ts}
+	}
+	older := app.ParseResult{Items: []app.MemoryItem{memory("1700000000")}}
+	newer := app.ParseResult{Items: []app.MemoryItem{memory("1800000000000")}}
+	for _, order := range [][]app.ParseResult{{older, newer}, {newer, older}} {
+		merged := app.MergeResults(order...)
+		if len(merged.Items) != 1 {
+			t.Fatalf("Expected 1 item, but got %d", len(merged.Items))
+		}
+		item := merged.Items[0]
+		if !strings.HasSuffix(item.URL, "ts=1800000000000") || len(item.Fallbacks) != 1 || !strings.HasSuffix(item.Fallbacks[0].URL, "ts=1700000000") {
+			t.Errorf("Expected the newest link first and the other as a fallback, got %q and %+v", item.URL, item.Fallbacks)
+		}
+	}
+}
+
+func TestProcessItemFallsBackToOtherExports(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired" {
+			http.Error(w, "Request has expired", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("video data"))
+	}))
+	defer server.Close()
+
+	outDir := t.TempDir()
+	item := app.MemoryItem{
+		Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Video", Extension: ".mp4",
+		URL: server.URL + "/expired", Fallbacks: []app.ItemLinks{{URL: server.URL + "/expired"}, {URL: server.URL + "/media"}},
+	}
+	if err := app.ProcessItem(context.Background(), item, app.Config{OutputDir: outDir}); err != nil {
+		t.Fatalf("Expected the fallback link to be downloaded, but got %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(outDir, "2023", "10", "Video 27-Oct-2023 10-00-00.mp4")); err != nil || string(data) != "video data" {
+		t.Errorf("Expected the media of the fallback link, got %q (%v)", data, err)
+	}
+
+	item.Fallbacks = item.Fallbacks[:1]
+	if err := app.ProcessItem(context.Background(), item, app.Config{OutputDir: t.TempDir()}); !errors.Is(err, app.ErrExpired) {
+		t.Errorf("Expected the error of the item's own link when every link fails, but got %v", err)
+	}
+}
+
+func TestParseJSONWarnings(t *testing.T) {
+	data := `{"Saved Media": [
+		{"Date": "2023-10-27 10:00:00 UTC", "Media Type": "Image", "Location": "", "Media Download Url": "http://example.com/a"},
+		{"Date": "yesterday", "Media Type": "Image", "Location": "", "Media Download Url": "http://example.com/b"},
+		{"Date": "2023-10-28 11:00:00 UTC", "Media Type": "Video", "Location": ""},
+		{"Date": 42},
+		{"Date": "2023-10-29 12:00:00 UTC", "Media Type": "Video", "Location": "", "Download Link": "http://example.com/c"}
+	]}`
+	result, err := app.ParseJSON([]byte(data))
+	if err != nil {
+		t.Fatalf("Expected bad entries not to abort parsing, but got %v", err)
+	}
+	if len(result.Items) != 2 {
+		t.Errorf("Expected 2 items, but got %d", len(result.Items))
+	}
+	if got := result.String(); got != "2 parsed, 3 skipped" {
+		t.Errorf("Expected \"2 parsed, 3 skipped\", but got %q", got)
+	}
+
+	expected := []struct {
+		row    int
+		reason string
+	}{{2, "invalid date"}, {3, "no download link"}, {4, "invalid entry"}}
+	if len(result.Warnings) != len(expected) {
+		t.Fatalf("Expected %d warnings, but got %v", len(expected), result.Warnings)
+	}
+	for i, want := range expected {
+		w := result.Warnings[i]
+		if w.Row != want.row || !strings.HasPrefix(w.Reason, want.reason) || w.Raw == "" {
+			t.Errorf("Warning %d: expected row %d %q, but got %+v", i, want.row, want.reason, w)
+		}
+	}
+
+	if _, err := app.ParseJSON([]byte("{")); err == nil {
+		t.Errorf("Expected an error for malformed JSON")
+	}
+}
+
+func TestRunner(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("video data"))
+	}))
+	defer server.Close()
+
+	items := []app.MemoryItem{
+		{Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Video", URL: server.URL + "/1", Extension: ".mp4"},
+		{Date: time.Date(2023, 11, 28, 11, 0, 0, 0, time.UTC), Type: "Video", URL: server.URL + "/2", Extension: ".mp4"},
+	}
+	cfg := app.Config{OutputDir: t.TempDir(), Concurrency: 2}
+
+	counts := map[app.EventKind]int{}
+	for ev := range app.NewRunner(cfg, items).Run(context.Background()) {
+		counts[ev.Kind]++
+		if ev.Kind == app.EventCompleted {
+			if _, err := os.Stat(ev.Path); err != nil {
+				t.Errorf("Expected output file for item %d: %v", ev.Index, err)
+			}
+		}
+	}
+
+	for _, kind := range []app.EventKind{app.EventStarted, app.EventDownloaded, app.EventMetadataApplied, app.EventCompleted} {
+		if counts[kind] != len(items) {
+			t.Errorf("Expected %d %s events, but got %d", len(items), kind, counts[kind])
+		}
+	}
+	if counts[app.EventFailed] != 0 {
+		t.Errorf("Expected no failed events, but got %d", counts[app.EventFailed])
+	}
+}
+
+func TestStreamRunner(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("media"))
+	}))
+	defer server.Close()
+
+	var doc strings.Builder
+	doc.WriteString(`{"Other": {"Saved Media": 1}, "Saved Media": [`)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&doc, `{"Date": "2023-10-27 10:00:%02d UTC", "Media Type": "Video", "Location": "", "Media Download Url": "%s/%d"},`, i, server.URL, i)
+	}
+	fmt.Fprintf(&doc, `{"Date": "2023-10-27 10:00:00 UTC", "Media Type": "Video", "Location": "", "Media Download Url": "%s/0"},`, server.URL)
+	doc.WriteString(`{"Date": "bad"}]}`)
+
+	path := filepath.Join(t.TempDir(), "memories_history.json")
+	if err := os.WriteFile(path, []byte(doc.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := app.OpenJSONStream(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	runner := app.NewStreamRunner(app.Config{OutputDir: t.TempDir(), Concurrency: 4}, stream.Items())
+	for ev := range runner.Run(context.Background()) {
+		if ev.Kind == app.EventFailed {
+			t.Errorf("Expected the item to succeed, but got %v", ev.Err)
+		}
+	}
+	result, err := stream.Wait()
+	if err != nil {
+		t.Fatalf("Expected the stream to end cleanly, but got %v", err)
+	}
+	if summary := runner.Summary(); summary.Total != 20 || summary.Succeeded != 20 {
+		t.Errorf("Expected 20 memories to succeed, got %d of %d", summary.Succeeded, summary.Total)
+	}
+	if len(result.Warnings) != 1 || result.Duplicates != 1 {
+		t.Errorf("Expected 1 warning and 1 duplicate, got %v and %d", result.Warnings, result.Duplicates)
+	}
+
+	htmlPath := filepath.Join(t.TempDir(), "memories_history.html")
+	if err := os.WriteFile(htmlPath, []byte("<table></table>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.OpenJSONStream(context.Background(), htmlPath); !errors.Is(err, app.ErrNotStreamable) {
+		t.Errorf("Expected ErrNotStreamable for an HTML export, got %v", err)
+	}
+}
+
+func TestDetectContainer(t *testing.T) {
+	tests := []struct {
+		header []byte
+		want   app.Container
+	}{
+		{[]byte{0xFF, 0xD8, 0xFF, 0xE0}, app.ContainerJPEG},
+		{[]byte("\x89PNG\r\n\x1a\n"), app.ContainerPNG},
+		{[]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), app.ContainerWebP},
+		{[]byte("\x00\x00\x00\x18ftypheic"), app.ContainerHEIC},
+		{[]byte("\x00\x00\x00\x18ftypisom"), app.ContainerMP4},
+		{[]byte("\x00\x00\x00\x14ftypqt  "), app.ContainerMOV},
+		{[]byte("video data"), app.ContainerUnknown},
+	}
+	for _, test := range tests {
+		if got := app.DetectContainer(test.header); got != test.want {
+			t.Errorf("DetectContainer(%q): expected %s, but got %s", test.header, test.want.Extension(), got.Extension())
+		}
+	}
+}
+
+func TestProcessItemDetectsContainer(t *testing.T) {
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/png":
+			w.Write(pngData.Bytes())
+		case "/mov":
+			w.Header().Set("Content-Type", "video/quicktime")
+			w.Write([]byte("not a recognisable header"))
+		}
+	}))
+	defer server.Close()
+
+	outDir := t.TempDir()
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	items := []app.MemoryItem{
+		{Date: date, Type: "Video", Media: app.MediaVideo, URL: server.URL + "/png", Extension: ".mp4"},
+		{Date: date, Type: "Image", Media: app.MediaImage, URL: server.URL + "/mov", Extension: ".jpg"},
+	}
+	for _, item := range items {
+		if err := app.ProcessItem(context.Background(), item, app.Config{OutputDir: outDir}); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+	}
+	for _, name := range []string{"Video 27-Oct-2023 10-00-00.png", "Image 27-Oct-2023 10-00-00.mov"} {
+		if _, err := os.Stat(filepath.Join(outDir, "2023", "10", name)); err != nil {
+			t.Errorf("Expected %s to exist: %v", name, err)
+		}
+	}
+}
+
+func TestParseTimeZone(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"", "UTC"},
+		{"utc", "UTC"},
+		{"Auto", "auto"},
+		{"America/Los_Angeles", "America/Los_Angeles"},
+	}
+	for _, test := range tests {
+		zone, err := app.ParseTimeZone(test.name)
+		if err != nil {
+			t.Errorf("ParseTimeZone(%q): expected no error, but got %v", test.name, err)
+		} else if zone.String() != test.want {
+			t.Errorf("ParseTimeZone(%q): expected %s, but got %s", test.name, test.want, zone)
+		}
+	}
+	if _, err := app.ParseTimeZone("Mars/Olympus_Mons"); err == nil {
+		t.Error("Expected an error for an unknown time zone")
+	}
+}
+
+func TestTimeZoneLocation(t *testing.T) {
+	zone, err := app.ParseTimeZone("auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		lat, lon float64
+		want     string
+		offset   int
+	}{
+		{34.0522, -118.2437, "America/Los_Angeles", -7 * 3600},
+		{48.8584, 2.2945, "Europe/Paris", 2 * 3600},
+		{-35.6762, 174.7633, "Pacific/Auckland", 12 * 3600},
+		// Nearer to the tz database's reference city of a neighbouring zone.
+		{42.2406, -8.7207, "Europe/Madrid", 2 * 3600},      // Vigo, not Lisbon
+		{36.1627, -86.7816, "America/Chicago", -5 * 3600},  // Nashville
+		{35.2220, -101.8313, "America/Chicago", -5 * 3600}, // Amarillo, not Denver
+		// Either side of a border.
+		{42.0469, -8.6446, "Europe/Madrid", 2 * 3600},      // Tui
+		{42.0286, -8.6339, "Europe/Lisbon", 1 * 3600},      // Valença, across the Minho
+		{35.9606, -83.9207, "America/New_York", -4 * 3600}, // Knoxville
+		{35.1717, -103.7250, "America/Denver", -6 * 3600},  // Tucumcari
+		{43.6600, 7.3000, "Europe/Paris", 2 * 3600},        // off Nice, in territorial waters
+		{-40, -20, "UTC-1", -3600},                         // South Atlantic
+	}
+	for _, test := range tests {
+		loc, err := app.NewLocation(test.lat, test.lon)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local := zone.LocalTime(app.MemoryItem{Date: date, Location: loc})
+		name, offset := local.Zone()
+		if local.Location().String() != test.want || offset != test.offset {
+			t.Errorf("%v: expected %s (%d), but got %s (%s, %d)", loc, test.want, test.offset, local.Location(), name, offset)
+		}
+	}
+	if local := zone.LocalTime(app.MemoryItem{Date: date}); local.Location() != time.UTC {
+		t.Errorf("Expected UTC for a memory without location, but got %s", local.Location())
+	}
+}
+
+func TestProcessItemLocalTime(t *testing.T) {
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jpegData.Bytes())
+	}))
+	defer server.Close()
+
+	zone, err := app.ParseTimeZone("auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, _ := app.NewLocation(34.0522, -118.2437)
+	// 23:30 in Los Angeles is already the next day in UTC.
+	item := app.MemoryItem{Date: time.Date(2023, 10, 28, 6, 30, 0, 0, time.UTC), Type: "Image", Location: loc, URL: server.URL, Extension: ".jpg"}
+	outDir := t.TempDir()
+	if err := app.ProcessItem(context.Background(), item, app.Config{OutputDir: outDir, TimeZone: zone}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outDir, "2023", "10", "Image 27-Oct-2023 23-30-00.jpg"))
+	if err != nil {
+		t.Fatalf("Expected the photo in the local day's folder: %v", err)
+	}
+	for _, want := range []string{"2023:10:27 23:30:00", "-07:00"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("Expected the EXIF data to contain %q", want)
+		}
+	}
+}
+
+func TestParseNameTemplate(t *testing.T) {
+	valid := []string{"", app.DefaultNameTemplate, "{year}/{month}/{type}_{date:YYYYMMDD_HHmmss}_{seq}{ext}", "{media}/{id:8}", "{lat:3},{lon:3}/{overlay:edited}"}
+	for _, text := range valid {
+		if _, err := app.ParseNameTemplate(text); err != nil {
+			t.Errorf("ParseNameTemplate(%q): expected no error, but got %v", text, err)
+		}
+	}
+	invalid := []string{"{year", "year}", "{color}", "{type:upper}", "{seq:x}", "/{year}", "{year}//{type}", "../{type}", "{type}:{date}", "{date:}"}
+	for _, text := range invalid {
+		if _, err := app.ParseNameTemplate(text); err == nil {
+			t.Errorf("ParseNameTemplate(%q): expected an error", text)
+		}
+	}
+}
+
+func TestPreviewName(t *testing.T) {
+	zone, _ := app.ParseTimeZone("America/Los_Angeles")
+	tests := []struct {
+		template, dateFormat, want string
+	}{
+		{"", "", "2023/10/Image 27-Oct-2023 23-30-15.jpg"},
+		{"", "YYYYMMDD_HHmmss", "2023/10/Image 20231027_233015.jpg"},
+		{"{year}/{month}/{type}_{date:YYYYMMDD_HHmmss}_{seq:3}{ext}", "", "2023/10/Image_20231027_233015_001.jpg"},
+		{"{media}/{day} {lat:2} {lon:2} {overlay:edited} {id:4}", "", "image/27 34.05 -118.24 edited 3f2a.jpg"},
+		{"{type}/{date:YYYY/MM}", "", "Image/2023_10.jpg"},
+	}
+	for _, test := range tests {
+		nameTemplate, err := app.ParseNameTemplate(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := app.PreviewName(app.Config{NameTemplate: nameTemplate, DateFormat: test.dateFormat, TimeZone: zone})
+		if got != filepath.FromSlash(test.want) {
+			t.Errorf("PreviewName(%q): expected %q, but got %q", test.template, test.want, got)
+		}
+	}
+}
+
+func TestProcessItemNameTemplate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("video data"))
+	}))
+	defer server.Close()
+
+	nameTemplate, err := app.ParseNameTemplate("{media}/{year}-{month}/{type}_{date:YYYYMMDD_HHmmss}_{seq}{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	items := []app.MemoryItem{
+		{Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Video", Media: app.MediaVideo, URL: server.URL + "/1", Extension: ".mp4"},
+		{Date: time.Date(2023, 11, 2, 8, 15, 0, 0, time.UTC), Type: "Video", Media: app.MediaVideo, URL: server.URL + "/2", Extension: ".mp4"},
+	}
+	runner := app.NewRunner(app.Config{OutputDir: outDir, NameTemplate: nameTemplate}, items)
+	for ev := range runner.Run(context.Background()) {
+		if ev.Err != nil {
+			t.Fatalf("Expected no error, but got %v", ev.Err)
+		}
+	}
+	for _, name := range []string{"video/2023-10/Video_20231027_100000_1.mp4", "video/2023-11/Video_20231102_081500_2.mp4"} {
+		if _, err := os.Stat(filepath.Join(outDir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("Expected %s to exist: %v", name, err)
+		}
+	}
+}
+
+func TestRunnerNameCollisions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	var items []app.MemoryItem
+	for i := 0; i < 3; i++ {
+		items = append(items, app.MemoryItem{Date: date, Type: "Video", Media: app.MediaVideo, URL: fmt.Sprintf("%s/%d", server.URL, i), Extension: ".mp4"})
+	}
+
+	// The first memory keeps the name and the others get the start of their
+	// ID, whichever worker finishes first and whether the input is streamed.
+	want := make(map[string]string)
+	for i, item := range items {
+		name := "Video 27-Oct-2023 10-00-00.mp4"
+		if i > 0 {
+			name = fmt.Sprintf("Video 27-Oct-2023 10-00-00_%s.mp4", app.NewItemID(item.Date, item.URL)[:8])
+		}
+		want[fmt.Sprintf("/%d", i)] = name
+	}
+	check := func(mode string, runner *app.Runner) {
+		got := make(map[string]string)
+		for ev := range runner.Run(context.Background()) {
+			if ev.Err != nil {
+				t.Fatalf("%s: expected no error, but got %v", mode, ev.Err)
+			}
+			if ev.Kind != app.EventCompleted {
+				continue
+			}
+			data, err := os.ReadFile(ev.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[string(data)] = filepath.Base(ev.Path)
+		}
+		for content, name := range want {
+			if got[content] != name {
+				t.Errorf("%s: expected %s to be named %s, but got %s", mode, content, name, got[content])
+			}
+		}
+	}
+
+	check("batch", app.NewRunner(app.Config{OutputDir: t.TempDir(), Concurrency: 3}, items))
+	source := make(chan app.MemoryItem, len(items))
+	for _, item := range items {
+		source <- item
+	}
+	close(source)
+	check("stream", app.NewStreamRunner(app.Config{OutputDir: t.TempDir(), Concurrency: 3}, source))
+}
+
+func TestRunnerKeepsEarlierNames(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	if w, err := zw.Create("abc-main.jpg"); err != nil {
+		t.Fatal(err)
+	} else {
+		w.Write(jpg.Bytes())
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/zip/") {
+			w.Write(archive.Bytes())
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	outDir := t.TempDir()
+	date := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	memory := func(id string, date time.Time) app.MemoryItem {
+		return app.MemoryItem{Date: date, Type: "Video", Media: app.MediaVideo, URL: server.URL + "/" + id, Extension: ".mp4", ID: id}
+	}
+	run := func(items ...app.MemoryItem) map[string]app.Event {
+		journal, err := app.OpenJournal(app.JournalPath(outDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer journal.Close()
+		runner := app.NewRunner(app.Config{OutputDir: outDir}, items)
+		runner.SetJournal(journal)
+		events := make(map[string]app.Event)
+		for ev := range runner.Run(context.Background()) {
+			if ev.Terminal() {
+				events[ev.Item.ID] = ev
+			}
+		}
+		return events
+	}
+	dir := filepath.Join(outDir, "2023", "01")
+	plain := filepath.Join(dir, "Video 01-Jan-2023 10-00-00.mp4")
+
+	// A later export adds a memory of the same second, with a lower ID.
+	if ev := run(memory("bbbbbbbbbbbb", date))["bbbbbbbbbbbb"]; ev.Kind != app.EventCompleted || ev.Path != plain {
+		t.Fatalf("Expected the first run to save %s, but got %v %s (%v)", plain, ev.Kind, ev.Path, ev.Err)
+	}
+	events := run(memory("aaaaaaaaaaaa", date), memory("bbbbbbbbbbbb", date))
+	if ev := events["bbbbbbbbbbbb"]; !errors.Is(ev.Err, app.ErrAlreadyDownloaded) {
+		t.Errorf("Expected the earlier memory to be skipped, but got %v (%v)", ev.Kind, ev.Err)
+	}
+	if ev := events["aaaaaaaaaaaa"]; ev.Path != filepath.Join(dir, "Video 01-Jan-2023 10-00-00_aaaaaaaa.mp4") {
+		t.Errorf("Expected the new memory to get a suffix, but got %s (%v)", ev.Path, ev.Err)
+	}
+	if data, err := os.ReadFile(plain); err != nil || string(data) != "/bbbbbbbbbbbb" {
+		t.Errorf("Expected the earlier memory's file to be kept, but got %q (%v)", data, err)
+	}
+
+	// Files the journal does not know about are not overwritten either.
+	later := date.Add(time.Hour)
+	stray := filepath.Join(dir, "Video 01-Jan-2023 11-00-00.MOV")
+	if err := os.WriteFile(stray, []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ev := run(memory("cccccccccccc", later))["cccccccccccc"]; ev.Path != filepath.Join(dir, "Video 01-Jan-2023 11-00-00_cccccccc.mp4") {
+		t.Errorf("Expected a suffix next to a file on disk, but got %s (%v)", ev.Path, ev.Err)
+	}
+	if data, err := os.ReadFile(stray); err != nil || string(data) != "stray" {
+		t.Errorf("Expected the file on disk to be kept, but got %q (%v)", data, err)
+	}
+
+	// Memories downloaded as archives are saved in the overlays folder, and
+	// keep their names there too.
+	zipped := func(id string, date time.Time) app.MemoryItem {
+		return app.MemoryItem{Date: date, Type: "Image", Media: app.MediaImage, URL: server.URL + "/zip/" + id, Extension: ".jpg", ID: id}
+	}
+	later = date.Add(2 * time.Hour)
+	overlayDir := filepath.Join(outDir, "overlays", "images", "2023", "01")
+	overlayPlain := filepath.Join(overlayDir, "Image 01-Jan-2023 12-00-00.jpg")
+	if ev := run(zipped("eeeeeeeeeeee", later))["eeeeeeeeeeee"]; ev.Kind != app.EventCompleted || ev.Path != overlayPlain {
+		t.Fatalf("Expected the first run to save %s, but got %v %s (%v)", overlayPlain, ev.Kind, ev.Path, ev.Err)
+	}
+	events = run(zipped("dddddddddddd", later), zipped("eeeeeeeeeeee", later))
+	if ev := events["eeeeeeeeeeee"]; !errors.Is(ev.Err, app.ErrAlreadyDownloaded) {
+		t.Errorf("Expected the earlier archived memory to be skipped, but got %v (%v)", ev.Kind, ev.Err)
+	}
+	if ev := events["dddddddddddd"]; ev.Path != filepath.Join(overlayDir, "Image 01-Jan-2023 12-00-00_dddddddd.jpg") {
+		t.Errorf("Expected the new archived memory to get a suffix, but got %s (%v)", ev.Path, ev.Err)
+	}
+}
+
+func TestRunnerSummary(t *testing.T) {
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/photo":
+			w.Write(jpegData.Bytes())
+		case "/broken":
+			w.Write([]byte("PK\x03\x04 this is not really an archive"))
+		}
+	}))
+	defer server.Close()
+
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	items := []app.MemoryItem{
+		{Date: date, Type: "Image", Location: app.Location{Latitude: 34.05, Longitude: -118.24, Valid: true}, URL: server.URL + "/photo", Extension: ".jpg"},
+		{Date: date.Add(time.Hour), Type: "Image", URL: server.URL + "/broken", Extension: ".jpg"},
+		{Date: date.Add(2 * time.Hour), Type: "Image", Extension: ".jpg"},
+	}
+	runner := app.NewRunner(app.Config{OutputDir: t.TempDir(), Concurrency: 2}, items)
+	for ev := range runner.Run(context.Background()) {
+		if ev.Kind == app.EventFailed && !strings.Contains(ev.Err.Error(), items[1].String()) {
+			t.Errorf("Expected the error to identify the item, but got %v", ev.Err)
+		}
+	}
+
+	expected := app.Summary{Total: 3, Succeeded: 1, Failed: 1, Skipped: 1}
+	if summary := runner.Summary(); summary != expected {
+		t.Errorf("Expected summary %+v, but got %+v", expected, summary)
+	}
+}
+
+func TestRunnerCancel(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	items := make([]app.MemoryItem, 5)
+	for i := range items {
+		items[i] = app.MemoryItem{Date: time.Date(2023, 10, 27, i, 0, 0, 0, time.UTC), Type: "Video", URL: server.URL, Extension: ".mp4"}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runner := app.NewRunner(app.Config{OutputDir: t.TempDir(), Concurrency: 1}, items)
+	events := runner.Run(ctx)
+
+	<-requested
+	cancel()
+	for ev := range events {
+		if ev.Kind == app.EventCanceled && !errors.Is(ev.Err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, but got %v", ev.Err)
+		}
+	}
+
+	summary := runner.Summary()
+	if summary.Canceled != 1 || summary.Done() != 1 {
+		t.Errorf("Expected only the in-flight item to be canceled, but got %+v", summary)
+	}
+}
+
+func TestDownloadFileStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<html>link expired</html>"))
+	}))
+	defer server.Close()
+
+	_, err := app.DownloadFile(context.Background(), server.URL)
+	var httpErr *app.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected an HTTPError with status 403, but got %v", err)
+	}
+	if app.IsTransient(err) {
+		t.Errorf("Expected a 403 to be a permanent failure")
+	}
+}
+
+func TestProcessItemRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch {
+		case r.URL.Path == "/gone":
+			w.WriteHeader(http.StatusNotFound)
+		case attempts == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case attempts == 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("video data"))
+		}
+	}))
+	defer server.Close()
+
+	cfg := app.Config{OutputDir: t.TempDir(), Retries: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 5 * time.Millisecond}
+	item := app.MemoryItem{Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Video", URL: server.URL, Extension: ".mp4"}
+	if err := app.ProcessItem(context.Background(), item, cfg); err != nil {
+		t.Fatalf("Expected the download to succeed after retrying, but got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, but got %d", attempts)
+	}
+
+	attempts = 0
+	item.URL = server.URL + "/gone"
+	if err := app.ProcessItem(context.Background(), item, cfg); err == nil {
+		t.Fatalf("Expected a 404 to fail the item")
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a permanent failure not to be retried, but got %d attempts", attempts)
+	}
+}
+
+func TestRunnerZippedOverlay(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"abc-main.jpg", "abc-overlay.png"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		if strings.HasSuffix(name, ".png") {
+			err = png.Encode(w, img)
+		} else {
+			err = jpeg.Encode(w, img, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive.Bytes())
+	}))
+	defer server.Close()
+
+	outDir := t.TempDir()
+	items := []app.MemoryItem{{Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Image", URL: server.URL, Extension: ".jpg"}}
+	runner := app.NewRunner(app.Config{OutputDir: outDir, KeepArchives: true}, items)
+	merged := false
+	for ev := range runner.Run(context.Background()) {
+		switch ev.Kind {
+		case app.EventMerged:
+			merged = true
+		case app.EventFailed:
+			t.Fatalf("Expected the item to succeed, but got %v", ev.Err)
+		}
+	}
+	if !merged {
+		t.Errorf("Expected the overlay to be merged")
+	}
+
+	for _, path := range []string{
+		filepath.Join(outDir, "overlays", "images", "2023", "10", "Image 27-Oct-2023 10-00-00.jpg"),
+		filepath.Join(outDir, "overlays", "archives", "2023", "10", "Image 27-Oct-2023 10-00-00.zip"),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to exist: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outDir, ".tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected the temp directory to be cleaned up, got %v", err)
+	}
+}
+
+func TestMergeKeepsImageMetadata(t *testing.T) {
+	// A 16x8 image stored sideways, red on the left and blue on the right,
+	// that is displayed rotated 90° clockwise.
+	stored := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 8 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			stored.Set(x, y, c)
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, stored, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// EXIF with Make "TestCam" and orientation 6, an ICC profile and an XMP packet.
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x02\x00")
+	tiff = append(tiff, 0x0F, 0x01, 2, 0, 8, 0, 0, 0, 38, 0, 0, 0)
+	tiff = append(tiff, 0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "TestCam\x00"...)
+	segment := func(marker byte, payload string) []byte {
+		return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	}
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description rdf:about="" xmlns:tiff="http://ns.adobe.com/tiff/1.0/" xmlns:xap="http://ns.adobe.com/xap/1.0/"` +
+		` xmlns:exif="http://ns.adobe.com/exif/1.0/" xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"` +
+		` tiff:Model="Test Model" xap:CreateDate="2001-01-01T00:00:00">` +
+		`<exif:DateTimeOriginal>2001-01-01T00:00:00</exif:DateTimeOriginal><exif:ExposureTime>1/60</exif:ExposureTime>` +
+		`<photoshop:DateCreated><rdf:Seq><rdf:li>2001-01-01</rdf:li></rdf:Seq></photoshop:DateCreated>` +
+		`</rdf:Description></rdf:RDF></x:xmpmeta>`
+	base := bytes.Join([][]byte{
+		encoded.Bytes()[:2],
+		segment(0xE1, "Exif\x00\x00"+string(tiff)),
+		segment(0xE1, "http://ns.adobe.com/xap/1.0/\x00"+xmp),
+		segment(0xE2, "ICC_PROFILE\x00\x01\x01test colour profile"),
+		encoded.Bytes()[2:],
+	}, nil)
+
+	var overlay bytes.Buffer
+	if err := png.Encode(&overlay, image.NewRGBA(image.Rect(0, 0, 8, 16))); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, data := range map[string][]byte{"abc-main.jpg": base, "abc-overlay.png": overlay.Bytes()} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive.Bytes())
+	}))
+	defer server.Close()
+
+	outDir := t.TempDir()
+	item := app.MemoryItem{Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Image", URL: server.URL, Extension: ".jpg"}
+	if err := app.ProcessItem(context.Background(), item, app.Config{OutputDir: outDir, XMP: true}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(outDir, "overlays", "images", "2023", "10", "Image 27-Oct-2023 10-00-00.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"TestCam", "2023:10:27 10:00:00", "ICC_PROFILE\x00\x01\x01test colour profile"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("Expected the merged image to contain %q", want)
+		}
+	}
+
+	// The original XMP packet keeps its other properties, while ours replace
+	// those it has, whatever their prefix.
+	i := bytes.Index(data, []byte("http://ns.adobe.com/xap/1.0/\x00"))
+	if i < 2 {
+		t.Fatal("Expected the merged image to have an XMP packet")
+	}
+	packet := data[i+len("http://ns.adobe.com/xap/1.0/\x00") : i-2+(int(data[i-2])<<8|int(data[i-1]))]
+	properties := make(map[string][]string)
+	d := xml.NewDecoder(bytes.NewReader(packet))
+	var text string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Expected a well-formed XMP packet, but got %v:\n%s", err, packet)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			text = ""
+			if tok.Name.Local == "Description" {
+				for _, a := range tok.Attr {
+					properties[a.Name.Space+a.Name.Local] = append(properties[a.Name.Space+a.Name.Local], a.Value)
+				}
+			}
+		case xml.CharData:
+			text += string(tok)
+		case xml.EndElement:
+			if text != "" && tok.Name.Local != "li" {
+				properties[tok.Name.Space+tok.Name.Local] = append(properties[tok.Name.Space+tok.Name.Local], text)
+			}
+		}
+	}
+	date := "2023-10-27T10:00:00+00:00"
+	for name, want := range map[string]string{
+		"http://ns.adobe.com/tiff/1.0/Model":                                  "Test Model",
+		"http://ns.adobe.com/exif/1.0/ExposureTime":                           "1/60",
+		"http://ns.adobe.com/xap/1.0/CreateDate":                              date,
+		"http://ns.adobe.com/exif/1.0/DateTimeOriginal":                       date,
+		"http://ns.adobe.com/photoshop/1.0/DateCreated":                       date,
+		"https://github.com/DrissiReda/snap-memory-downloader/ns/1.0/Overlay": "true",
+	} {
+		if got := properties[name]; len(got) != 1 || got[0] != want {
+			t.Errorf("Expected XMP property %s to be [%s], but got %q", name, want, got)
+		}
+	}
+	if bytes.Contains(packet, []byte("2001-01-01")) {
+		t.Errorf("Expected the original dates to be replaced:\n%s", packet)
+	}
+	if bytes.Contains(data, []byte{0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0}) || bytes.Contains(data, []byte{0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6}) {
+		t.Error("Expected the orientation to be reset once applied")
+	}
+
+	merged, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := merged.Bounds().Size(); size != image.Pt(8, 16) {
+		t.Fatalf("Expected the image to be turned upright to 8x16, got %v", size)
+	}
+	if r, _, b, _ := merged.At(4, 2).RGBA(); r < b {
+		t.Errorf("Expected the top of the upright image to be red")
+	}
+	if r, _, b, _ := merged.At(4, 13).RGBA(); b < r {
+		t.Errorf("Expected the bottom of the upright image to be blue")
+	}
+}
+
+func TestProcessItemXMP(t *testing.T) {
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/photo" {
+			w.Write(photo.Bytes())
+			return
+		}
+		w.Write([]byte("video data"))
+	}))
+	defer server.Close()
+
+	loc, _ := app.NewLocation(34.0522, -118.2437)
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	outDir := t.TempDir()
+	items := []app.MemoryItem{
+		{Date: date, Type: "Image", Location: loc, URL: server.URL + "/photo?mid=ABC-123", Extension: ".jpg"},
+		{Date: date, Type: "Video", Media: app.MediaVideo, URL: server.URL + "/video", Extension: ".mp4"},
+	}
+	for _, item := range items {
+		if err := app.ProcessItem(context.Background(), item, app.Config{OutputDir: outDir, XMP: true}); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+	}
+
+	photoPath := filepath.Join(outDir, "2023", "10", "Image 27-Oct-2023 10-00-00.jpg")
+	sidecar, err := os.ReadFile(photoPath + ".xmp")
+	if err != nil {
+		t.Fatalf("Expected an XMP sidecar for the photo: %v", err)
+	}
+	// Lightroom looks for the sidecar under the name without the extension.
+	if basename, err := os.ReadFile(filepath.Join(outDir, "2023", "10", "Image 27-Oct-2023 10-00-00.xmp")); err != nil || !bytes.Equal(basename, sidecar) {
+		t.Errorf("Expected the sidecar under the photo's basename too: %v", err)
+	}
+	if err := xml.Unmarshal(sidecar, new(struct{})); err != nil {
+		t.Errorf("Expected the sidecar to be well-formed XML: %v", err)
+	}
+	for _, want := range []string{
+		`xmp:CreateDate="2023-10-27T10:00:00+00:00"`,
+		`exif:GPSLatitude="34,3.132000N"`,
+		`exif:GPSLongitude="118,14.622000W"`,
+		`snap:MediaType="Image"`,
+		`snap:ID="` + app.NewItemID(date, items[0].URL) + `"`,
+		`snap:MediaID="abc-123"`,
+		`snap:Overlay="false"`,
+	} {
+		if !bytes.Contains(sidecar, []byte(want)) {
+			t.Errorf("Expected the sidecar to contain %s, got:\n%s", want, sidecar)
+		}
+	}
+
+	data, err := os.ReadFile(photoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("http://ns.adobe.com/xap/1.0/\x00")) || !bytes.Contains(data, []byte(`snap:MediaType="Image"`)) {
+		t.Error("Expected XMP to be embedded in the photo")
+	}
+	if !bytes.Contains(data, []byte("2023:10:27 10:00:00")) {
+		t.Error("Expected the photo to keep its EXIF date")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("Expected the photo to stay a valid JPEG: %v", err)
+	}
+
+	sidecar, err = os.ReadFile(filepath.Join(outDir, "2023", "10", "Video 27-Oct-2023 10-00-00.mp4.xmp"))
+	if err != nil {
+		t.Fatalf("Expected an XMP sidecar for the video: %v", err)
+	}
+	if !bytes.Contains(sidecar, []byte(`snap:MediaType="Video"`)) || bytes.Contains(sidecar, []byte("GPSLatitude")) {
+		t.Errorf("Expected the video sidecar to hold its type and no location, got:\n%s", sidecar)
+	}
+}
+
+func TestProcessItemWritesAtomically(t *testing.T) {
+	var base bytes.Buffer
+	if err := jpeg.Encode(&base, image.NewRGBA(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, data := range map[string][]byte{"abc-main.jpg": base.Bytes(), "abc-overlay.png": []byte("not an image")} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/zip":
+			w.Write(archive.Bytes())
+		case "/truncated":
+			w.Write(base.Bytes()[:base.Len()/2])
+		default:
+			w.Write(base.Bytes())
+		}
+	}))
+	defer server.Close()
+
+	outDir := t.TempDir()
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	if err := app.ProcessItem(context.Background(), app.MemoryItem{Date: date, Type: "Image", URL: server.URL, Extension: ".jpg"}, app.Config{OutputDir: outDir}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(outDir, "2023", "10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "Image 27-Oct-2023 10-00-00.jpg" {
+		t.Errorf("Expected only the photo in the output folder, got %v", entries)
+	}
+
+	// A failed merge must keep the file of a previous run and leave no temporary files.
+	folder := filepath.Join(outDir, "overlays", "images", "2023", "10")
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := filepath.Join(folder, "Image 27-Oct-2023 10-00-00.jpg")
+	if err := os.WriteFile(previous, []byte("previous run"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.ProcessItem(context.Background(), app.MemoryItem{Date: date, Type: "Image", URL: server.URL + "/zip", Extension: ".jpg"}, app.Config{OutputDir: outDir}); err == nil {
+		t.Fatal("Expected merging an undecodable overlay to fail")
+	}
+	if data, err := os.ReadFile(previous); err != nil || string(data) != "previous run" {
+		t.Errorf("Expected the previous file to be kept, got %q, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(folder); len(entries) != 1 {
+		t.Errorf("Expected no temporary files to be left behind, got %v", entries)
+	}
+
+	// So must a download whose metadata cannot be written: the output is
+	// only renamed into place once it is complete.
+	folder = filepath.Join(outDir, "2023", "10")
+	previous = filepath.Join(folder, "Image 27-Oct-2023 11-00-00.jpg")
+	if err := os.WriteFile(previous, []byte("previous run"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	item := app.MemoryItem{Date: date.Add(time.Hour), Type: "Image", URL: server.URL + "/truncated", Extension: ".jpg"}
+	if err := app.ProcessItem(context.Background(), item, app.Config{OutputDir: outDir}); err == nil || !strings.Contains(err.Error(), "metadata") {
+		t.Fatalf("Expected writing the metadata of a truncated photo to fail, but got %v", err)
+	}
+	if data, err := os.ReadFile(previous); err != nil || string(data) != "previous run" {
+		t.Errorf("Expected the previous file to be kept, got %q, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(folder); len(entries) != 2 {
+		t.Errorf("Expected no temporary files to be left behind, got %v", entries)
+	}
+}
+
+// mp4Box builds an MP4 box from its type and payload.
+func mp4Box(typ string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(box, typ...), data...)
+}
+
+// testMP4 builds a movie with one track whose single chunk holds "MDATDATA",
+// with the movie header before or after the media data.
+func testMP4(moovFirst bool) []byte {
+	header := func(typ string, size int) []byte {
+		return mp4Box(typ, make([]byte, size)) // version 0, zero times
+	}
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isom"))
+	mdat := mp4Box("mdat", []byte("MDATDATA"))
+	moov := func(chunk uint32) []byte {
+		stco := mp4Box("stco", []byte{0, 0, 0, 0, 0, 0, 0, 1}, binary.BigEndian.AppendUint32(nil, chunk))
+		trak := mp4Box("trak", header("tkhd", 84), mp4Box("mdia", header("mdhd", 24), mp4Box("minf", mp4Box("stbl", stco))))
+		return mp4Box("moov", header("mvhd", 100), trak)
+	}
+	if moovFirst {
+		chunk := len(ftyp) + len(moov(0)) + 8
+		return bytes.Join([][]byte{ftyp, moov(uint32(chunk)), mdat}, nil)
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov(uint32(len(ftyp) + 8))}, nil)
+}
+
+func TestProcessItemVideoMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testMP4(r.URL.Path == "/faststart"))
+	}))
+	defer server.Close()
+
+	loc, _ := app.NewLocation(34.0522, -118.2437)
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	created := uint32(date.Unix() - time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	for _, path := range []string{"/faststart", "/"} {
+		outDir := t.TempDir()
+		item := app.MemoryItem{Date: date, Type: "Video", Media: app.MediaVideo, Location: loc, URL: server.URL + path, Extension: ".mp4"}
+		if err := app.ProcessItem(context.Background(), item, app.Config{OutputDir: outDir}); err != nil {
+			t.Fatalf("%s: expected no error, but got %v", path, err)
+		}
+		data, err := os.ReadFile(filepath.Join(outDir, "2023", "10", "Video 27-Oct-2023 10-00-00.mp4"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, typ := range []string{"mvhd", "tkhd", "mdhd"} {
+			i := bytes.Index(data, []byte(typ)) + 4
+			if got := binary.BigEndian.Uint32(data[i+4:]); got != created {
+				t.Errorf("%s: expected %s creation time %d, but got %d", path, typ, created, got)
+			}
+		}
+		if !bytes.Contains(data, []byte("\xa9xyz")) || !bytes.Contains(data, []byte("+34.0522-118.2437/")) {
+			t.Errorf("%s: expected a location atom", path)
+		}
+		i := bytes.Index(data, []byte("stco")) + 12
+		if chunk := binary.BigEndian.Uint32(data[i:]); !bytes.HasPrefix(data[chunk:], []byte("MDATDATA")) {
+			t.Errorf("%s: expected the chunk offset to point at the media data, got %d", path, chunk)
+		}
+	}
+}
+
+// writeZip creates a ZIP archive at path holding the given files.
+func writeZip(t *testing.T, path string, files map[string][]byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestParseExportZip(t *testing.T) {
+	var jpg, pngData bytes.Buffer
+	jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 16, 16)), nil)
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 16, 16)))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("video data"))
+	}))
+	defer server.Close()
+
+	memories := fmt.Sprintf(`{"Saved Media": [
+		{"Date": "2023-10-27 10:00:00 UTC", "Media Type": "Image", "Location": "", "Download Link": "https://app.snapchat.com/dmd/memories?uid=u&mid=AAA-1"},
+		{"Date": "2023-10-28 11:00:00 UTC", "Media Type": "Image", "Location": "", "Download Link": "https://app.snapchat.com/dmd/memories?uid=u&mid=BBB-2"},
+		{"Date": "2023-10-29 12:00:00 UTC", "Media Type": "Video", "Location": "", "Media Download Url": "%s/video.mp4"}
+	]}`, server.URL)
+
+	dir := t.TempDir()
+	first := filepath.Join(dir, "mydata~1700000000000.zip")
+	writeZip(t, first, map[string][]byte{
+		"json/memories_history.json":         []byte(memories),
+		"memories/2023-10-27_aaa-1-main.jpg": jpg.Bytes(),
+	})
+	writeZip(t, filepath.Join(dir, "mydata~1700000000000-2.zip"), map[string][]byte{
+		"memories/2023-10-27_aaa-1-overlay.png": pngData.Bytes(),
+		"memories/2023-10-28_bbb-2-main.jpg":    jpg.Bytes(),
+	})
+	writeZip(t, filepath.Join(dir, "mydata~1800000000000.zip"), map[string][]byte{
+		"memories/2023-10-29_ccc-3-main.mp4": []byte("other export"),
+	})
+
+	result, err := app.LoadInput(first)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if got := result.String(); got != "3 parsed, 0 skipped, 2 included in the export" {
+		t.Errorf("Unexpected parse result %q", got)
+	}
+	if b := result.Items[0].Bundled; b == nil || b.Overlay.Name == "" {
+		t.Fatalf("Expected the first memory to be bundled with its overlay, got %+v", b)
+	}
+
+	outDir := t.TempDir()
+	runner := app.NewRunner(app.Config{OutputDir: outDir}, result.Items)
+	merged := 0
+	for ev := range runner.Run(context.Background()) {
+		switch ev.Kind {
+		case app.EventMerged:
+			merged++
+		case app.EventFailed:
+			t.Fatalf("Expected the item to succeed, but got %v", ev.Err)
+		}
+	}
+	if summary := runner.Summary(); summary.Succeeded != 3 || merged != 1 {
+		t.Errorf("Expected 3 succeeded with 1 merged overlay, got %s and %d merged", summary, merged)
+	}
+	for _, path := range []string{
+		filepath.Join(outDir, "overlays", "images", "2023", "10", "Image 27-Oct-2023 10-00-00.jpg"),
+		filepath.Join(outDir, "2023", "10", "Image 28-Oct-2023 11-00-00.jpg"),
+		filepath.Join(outDir, "2023", "10", "Video 29-Oct-2023 12-00-00.mp4"),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to exist: %v", path, err)
+		}
+	}
+
+	if _, err := app.LoadInput(filepath.Join(dir, "mydata~1800000000000.zip")); err == nil {
+		t.Errorf("Expected an error for an export without a memories file")
+	}
+}
+
+func TestNewItemID(t *testing.T) {
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	first := app.NewItemID(date, "https://app.snapchat.com/dmd/memories?uid=u1&sid=s1&mid=m1&ts=1700000000&sig=abc")
+	second := app.NewItemID(date, "https://app.snapchat.com/dmd/memories?mid=m1&sid=s1&uid=u1&ts=1800000000&sig=def")
+	if first != second {
+		t.Errorf("Expected re-signed links to keep the same ID, but got %s and %s", first, second)
+	}
+	if other := app.NewItemID(date, "https://app.snapchat.com/dmd/memories?uid=u1&sid=s1&mid=m2&ts=1700000000&sig=abc"); other == first {
+		t.Errorf("Expected different memories to get different IDs")
+	}
+	if other := app.NewItemID(date.Add(time.Second), "https://app.snapchat.com/dmd/memories?uid=u1&sid=s1&mid=m1"); other == first {
+		t.Errorf("Expected different capture times to get different IDs")
+	}
+}
+
+func TestRunnerResumesFromJournal(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("mid") == "broken" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("video data"))
+	}))
+	defer server.Close()
+
+	var items []app.MemoryItem
+	for i, mid := range []string{"a", "b", "broken"} {
+		date := time.Date(2023, 10, 27, i, 0, 0, 0, time.UTC)
+		u := server.URL + "/?mid=" + mid
+		items = append(items, app.MemoryItem{Date: date, Type: "Video", URL: u, Extension: ".mp4", ID: app.NewItemID(date, u)})
+	}
+	cfg := app.Config{OutputDir: t.TempDir(), Concurrency: 2}
+
+	run := func() app.Summary {
+		journal, err := app.OpenJournal(app.JournalPath(cfg.OutputDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer journal.Close()
+		runner := app.NewRunner(cfg, items)
+		runner.SetJournal(journal)
+		for range runner.Run(context.Background()) {
+		}
+		return runner.Summary()
+	}
+
+	if summary := run(); summary.Succeeded != 2 || summary.Failed != 1 {
+		t.Fatalf("Unexpected first run summary: %+v", summary)
+	}
+	requests.Store(0)
+	if summary := run(); summary.AlreadyDownloaded != 2 || summary.Failed != 1 {
+		t.Errorf("Expected the second run to skip completed items, but got %+v", summary)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected only the failed item to be requested again, but got %d requests", n)
+	}
+}
+
+func TestJournalRecoversFromTornLine(t *testing.T) {
+	path := app.JournalPath(t.TempDir())
+	torn := `{"id":"aaaa","state":"done","path":"a.jpg","time":"2023-10-27T10:00:00Z"}` + "\n" + `{"id":"bbbb","sta`
+	if err := os.WriteFile(path, []byte(torn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := app.OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Record(app.JournalEntry{ID: "cccc", State: app.JournalDone, Path: "c.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	journal, err = app.OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	for _, id := range []string{"aaaa", "cccc"} {
+		if entry, ok := journal.Lookup(id); !ok || entry.State != app.JournalDone {
+			t.Errorf("Expected %s to be recorded as done, but got %+v", id, entry)
+		}
+	}
+	if _, ok := journal.Lookup("bbbb"); ok {
+		t.Error("Expected the torn entry to be ignored")
+	}
+}
+
+// flakyMediaServer serves body with an ETag, but drops the connection halfway
+// through the first response.
+func flakyMediaServer(t *testing.T, body []byte, etags ...string) (*httptest.Server, *[]string) {
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		etag := etags[min(len(ranges), len(etags))-1]
+		if len(ranges) == 1 {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nAccept-Ranges: bytes\r\nETag: %s\r\n\r\n", len(body), etag)
+			buf.Write(body[:len(body)/2])
+			buf.Flush()
+			conn.Close()
+			return
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	return server, &ranges
+}
+
+func TestProcessItemResumesPartialDownload(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	server, ranges := flakyMediaServer(t, body, `"v1"`)
+	defer server.Close()
+
+	cfg := app.Config{OutputDir: t.TempDir(), Retries: 2, RetryBaseDelay: time.Millisecond}
+	item := app.MemoryItem{Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Video", URL: server.URL, Extension: ".mp4"}
+	if err := app.ProcessItem(context.Background(), item, cfg); err != nil {
+		t.Fatalf("Expected the download to resume, but got %v", err)
+	}
+
+	if len(*ranges) != 2 || (*ranges)[1] != fmt.Sprintf("bytes=%d-", len(body)/2) {
+		t.Errorf("Expected the retry to request the missing bytes, but got ranges %q", *ranges)
+	}
+	got, err := os.ReadFile(filepath.Join(cfg.OutputDir, "2023", "10", "Video 27-Oct-2023 10-00-00.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("Expected the resumed file to match the original (%d bytes), but got %d bytes", len(body), len(got))
+	}
+}
+
+func TestProcessItemRestartsWhenValidatorChanged(t *testing.T) {
+	body := bytes.Repeat([]byte("abcdefghij"), 1000)
+	server, ranges := flakyMediaServer(t, body, `"v1"`, `"v2"`)
+	defer server.Close()
+
+	cfg := app.Config{OutputDir: t.TempDir(), Retries: 2, RetryBaseDelay: time.Millisecond}
+	item := app.MemoryItem{Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Video", URL: server.URL, Extension: ".mp4"}
+	if err := app.ProcessItem(context.Background(), item, cfg); err != nil {
+		t.Fatalf("Expected the download to succeed, but got %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(cfg.OutputDir, "2023", "10", "Video 27-Oct-2023 10-00-00.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*ranges) != 2 || !bytes.Equal(got, body) {
+		t.Errorf("Expected a full re-download after the ETag changed, got %d bytes after ranges %q", len(got), *ranges)
+	}
+}
+
+func TestParseHTMLDownloadLink(t *testing.T) {
+	link, want := "https://app.snapchat.com/dmd/memories?uid=u&amp;mid=m", "https://app.snapchat.com/dmd/memories?uid=u&mid=m"
+	tests := []struct {
+		kind              string
+		onclick           string
+		wantURL, wantLink string
+	}{
+		{"a POST link", "downloadMemories('" + link + "', this, false); return false;", "", want},
+		{"a link without isGetRequest", "return downloadMemories('" + link + "')", "", want},
+		{"a GET link", "downloadMemories('" + link + "', this, true)", want, ""},
+	}
+	for _, test := range tests {
+		html := `<table><tr>
+			<td>2023-10-27 10:00:00 UTC</td><td>Image</td><td>Latitude, Longitude: 0.0, 0.0</td>
+			<td><a href="#" onclick="` + test.onclick + `">Download</a></td>
+		</tr></table>`
+		items := app.ParseHTML(html).Items
+		if len(items) != 1 {
+			t.Fatalf("Expected 1 item, but got %d", len(items))
+		}
+		if items[0].URL != test.wantURL || items[0].DownloadLink != test.wantLink {
+			t.Errorf("Expected %s to give URL %q and link %q, but got %q and %q", test.kind, test.wantURL, test.wantLink, items[0].URL, items[0].DownloadLink)
+		}
+	}
+}
+
+func TestParseHTMLMarkup(t *testing.T) {
+	html := `<html><body>
+		<table class="summary"><tr><td>Total</td><td>3</td></tr></table>
+		<table class="memories">
+			<tr class="header"><th>Date</th><th>Media Type</th><th>Location</th><th></th></tr>
+			<tr class="row odd">
+				<td style="width:25%">2023-10-27 10:00:00 UTC</td>
+				<td style="width:25%">Tom &amp; Jerry&#39;s Video</td>
+				<td>Latitude, Longitude:<br>34.05, -118.24</td>
+				<td><a href="#" onclick="downloadMemories('https://example.com/a?mid=1&amp;sig=x', this, true)">Download</a></td>
+			</tr>
+			<tr class="row even">
+				<td>not a date</td><td>Image</td><td></td>
+				<td><a href="#" onclick="downloadMemories('https://example.com/b', this, true)">Download</a></td>
+			<tr class="row odd"><td>2023-10-28 11:00:00 UTC</td><td>Image</td><td></td><td></td>
+		</table>
+	</body></html>`
+	result := app.ParseHTML(html)
+	items, warnings := result.Items, result.Warnings
+	if len(items) != 1 {
+		t.Fatalf("Expected 1 item, but got %d", len(items))
+	}
+	if items[0].Type != "Tom & Jerry's Video" || items[0].Extension != ".mp4" {
+		t.Errorf("Expected decoded video type, but got %q (%s)", items[0].Type, items[0].Extension)
+	}
+	if want := (app.Location{Latitude: 34.05, Longitude: -118.24, Valid: true}); items[0].Location != want {
+		t.Errorf("Expected location %s, but got %s", want, items[0].Location)
+	}
+	if items[0].URL != "https://example.com/a?mid=1&sig=x" {
+		t.Errorf("Expected decoded URL, but got %q", items[0].URL)
+	}
+
+	if len(warnings) != 2 {
+		t.Fatalf("Expected 2 warnings, but got %v", warnings)
+	}
+	if warnings[0].Row != 2 || !strings.Contains(warnings[0].Reason, "invalid date") || !strings.Contains(warnings[0].Raw, "not a date") {
+		t.Errorf("Unexpected warning for the bad date: %+v", warnings[0])
+	}
+	if strings.Contains(warnings[0].Raw, "row odd") || !strings.HasPrefix(warnings[1].Raw, `<tr class="row odd">`) {
+		t.Errorf("Expected the unclosed row's raw markup to end where the next row starts, got %q and %q", warnings[0].Raw, warnings[1].Raw)
+	}
+	if warnings[1].Row != 3 || warnings[1].Reason != "no download link" {
+		t.Errorf("Unexpected warning for the missing link: %+v", warnings[1])
+	}
+}
+
+func TestProcessItemResolvesDownloadLink(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dmd/memories":
+			body, _ := io.ReadAll(r.Body)
+			if r.Method != http.MethodPost || string(body) != "uid=u&mid=m" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, "%s/cdn/media.mp4\n", server.URL)
+		case "/cdn/media.mp4":
+			w.Write([]byte("video data"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	cfg := app.Config{OutputDir: t.TempDir()}
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	link := server.URL + "/dmd/memories?uid=u&mid=m"
+	for _, item := range []app.MemoryItem{
+		{Date: date, Type: "Video", Extension: ".mp4", DownloadLink: link},
+		{Date: date, Type: "Video", Extension: ".mp4", DownloadLink: link, URL: server.URL + "/expired.mp4"},
+	} {
+		if err := app.ProcessItem(context.Background(), item, cfg); err != nil {
+			t.Errorf("Expected the download link to be resolved, but got %v", err)
+		}
+	}
+
+	resolved := false
+	cfg.Resolver = app.ResolverFunc(func(ctx context.Context, item app.MemoryItem) (string, error) {
+		resolved = true
+		return server.URL + "/cdn/media.mp4", nil
+	})
+	if err := app.ProcessItem(context.Background(), app.MemoryItem{Date: date, Type: "Video", Extension: ".mp4", DownloadLink: "custom"}, cfg); err != nil || !resolved {
+		t.Errorf("Expected the configured resolver to be used, got resolved=%v err=%v", resolved, err)
+	}
+}
+
+func TestExpiredLinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/s3":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>"))
+		case "/signed":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Access denied"))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path    string
+		expired bool
+	}{
+		{"/s3", true},
+		{"/signed?Expires=1600000000&Signature=abc", true},
+		{"/signed?Expires=4000000000&Signature=abc", false},
+		{"/denied", false},
+	}
+	for _, test := range tests {
+		_, err := app.DownloadFile(context.Background(), server.URL+test.path)
+		if errors.Is(err, app.ErrExpired) != test.expired {
+			t.Errorf("%s: expected expired=%v, but got %v", test.path, test.expired, err)
+		}
+	}
+
+	items := []app.MemoryItem{{Date: time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC), Type: "Image", URL: server.URL + "/s3", Extension: ".jpg"}}
+	runner := app.NewRunner(app.Config{OutputDir: t.TempDir()}, items)
+	for range runner.Run(context.Background()) {
+	}
+	if summary := runner.Summary(); summary.Expired != 1 || summary.Failed != 0 {
+		t.Errorf("Expected the item to be reported as expired, but got %+v", summary)
+	}
+}
+
+func TestRefreshItems(t *testing.T) {
+	date := time.Date(2023, 10, 27, 10, 0, 0, 0, time.UTC)
+	items := []app.MemoryItem{
+		{Date: date, Type: "Image", Location: app.Location{Latitude: 1.5, Longitude: 2.5, Valid: true}, URL: "https://old/1", ID: "first"},
+		{Date: date, Type: "Video", URL: "https://old/2", ID: "second"},
+		{Date: date.Add(time.Hour), Type: "Image", URL: "https://old/3", ID: "third"},
+	}
+	fresh := []app.MemoryItem{
+		{Date: date, Type: "Video", URL: "https://new/2"},
+		{Date: date, Type: "Image", Location: app.Location{Latitude: 1.5, Longitude: 2.5, Accuracy: 10, Valid: true}, URL: "https://new/1", DownloadLink: "https://new/link/1"},
+	}
+
+	refreshed, matched := app.RefreshItems(items, fresh)
+	if matched != 2 {
+		t.Errorf("Expected 2 matches, but got %d", matched)
+	}
+	expected := []string{"https://new/1", "https://new/2", "https://old/3"}
+	for i, item := range refreshed {
+		if item.URL != expected[i] {
+			t.Errorf("Item %d: expected URL %s, but got %s", i, expected[i], item.URL)
+		}
+		if item.ID != items[i].ID {
+			t.Errorf("Item %d: expected the ID to be kept, but got %s", i, item.ID)
+		}
+	}
+	if refreshed[0].DownloadLink != "https://new/link/1" {
+		t.Errorf("Expected the download link to be refreshed, but got %q", refreshed[0].DownloadLink)
+	}
+}